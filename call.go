@@ -0,0 +1,88 @@
+package signalr
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/carterjones/helpers/trace"
+)
+
+// Call builds a call to a server hub method, e.g.
+//
+//	c.Call("chatHub", "Send").Arg("room1").Arg(42).Arg(msg).Invoke(ctx)
+//
+// Each argument is encoded with the client's codec when it is added, so the
+// message's arguments are sent as a JSON array of already-encoded values, and
+// an argument that can't be encoded fails the call instead of the write. A
+// Call is not safe for concurrent use.
+type Call struct {
+	c       *Client
+	hub     string
+	method  string
+	args    []interface{}
+	timeout time.Duration
+	err     error
+}
+
+// Call starts building a call to a method on a server hub.
+func (c *Client) Call(hub, method string) *Call {
+	return &Call{c: c, hub: hub, method: method}
+}
+
+// Arg appends an argument to the call.
+func (call *Call) Arg(v interface{}) *Call {
+	if call.err != nil {
+		return call
+	}
+
+	data, err := call.c.codec().Marshal(v)
+	if err != nil {
+		trace.Error(err)
+		call.err = err
+		return call
+	}
+
+	call.args = append(call.args, json.RawMessage(data))
+	return call
+}
+
+// Timeout sets the timeout of the call, taking precedence over the method's
+// timeout set with SetMethodTimeout and over InvokeTimeout. It applies only if
+// the context passed to Invoke has no deadline.
+func (call *Call) Timeout(d time.Duration) *Call {
+	call.timeout = d
+	return call
+}
+
+// Invoke makes the call and waits for its result, like Client.Invoke. The hub
+// state is attached to the call as for any other hub message.
+func (call *Call) Invoke(ctx context.Context) (result json.RawMessage, err error) {
+	if call.err != nil {
+		err = call.err
+		return
+	}
+
+	if _, ok := ctx.Deadline(); !ok && call.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = call.c.withTimeout(ctx, call.timeout)
+		defer cancel()
+	}
+
+	return call.c.Invoke(ctx, call.hub, call.method, call.args...)
+}
+
+// InvokeInto makes the call like Invoke and decodes the result into v.
+func (call *Call) InvokeInto(ctx context.Context, v interface{}) (err error) {
+	result, err := call.Invoke(ctx)
+	if err != nil {
+		return
+	}
+
+	err = call.c.codec().Unmarshal(result, v)
+	if err != nil {
+		trace.Error(err)
+		return
+	}
+	return
+}
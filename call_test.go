@@ -0,0 +1,95 @@
+package signalr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCallArgs(t *testing.T) {
+	s := newTestServer(t)
+	c, conn := s.connected()
+
+	results := make(chan room, 1)
+	errs := make(chan error, 1)
+	go func() {
+		var r room
+		err := c.Call("chathub", "join").
+			Arg("room1").
+			Arg(42).
+			Arg(room{Name: "lobby", Users: 3}).
+			Arg(nil).
+			Arg([]int{1, 2}).
+			InvokeInto(context.Background(), &r)
+		errs <- err
+		results <- r
+	}()
+
+	_, p, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cm struct {
+		I json.Number
+		A []json.RawMessage
+	}
+	err = json.Unmarshal(p, &cm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{`"room1"`, `42`, `{"Name":"lobby","Users":3}`, `null`, `[1,2]`}
+	if len(cm.A) != len(want) {
+		t.Fatalf("arguments %s sent, want %v", p, want)
+	}
+	for i := range want {
+		if string(cm.A[i]) != want[i] {
+			t.Errorf("argument %d = %s, want %s", i+1, cm.A[i], want[i])
+		}
+	}
+
+	sendFrame(t, conn, `{"I":"`+cm.I.String()+`","R":{"Name":"room1","Users":1}}`)
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if r := <-results; r != (room{Name: "room1", Users: 1}) {
+		t.Errorf("result = %+v", r)
+	}
+}
+
+func TestCallBadArg(t *testing.T) {
+	c := newClient("example.com", "1.5", "")
+	defer c.Close()
+
+	_, err := c.Call("chathub", "send").Arg("hi").Arg(make(chan int)).Arg(1).Invoke(context.Background())
+	var ue *json.UnsupportedTypeError
+	if !errors.As(err, &ue) {
+		t.Errorf("Invoke() = %v, want a *json.UnsupportedTypeError", err)
+	}
+}
+
+func TestCallTimeout(t *testing.T) {
+	s := newTestServer(t)
+	clk := newFakeClock()
+	c, conn := s.connected(withClock(clk))
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := c.Call("chathub", "slow").Timeout(time.Second).Invoke(context.Background())
+		errs <- err
+	}()
+
+	// The call is never answered.
+	readInvocation(t, conn)
+	clk.waitTimers(t, 1)
+	clk.Advance(time.Second)
+	select {
+	case err := <-errs:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Invoke() = %v, want the call to time out", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("call didn't time out")
+	}
+}
@@ -0,0 +1,68 @@
+package signalr
+
+import (
+	"context"
+	"time"
+)
+
+// clock is the source of time for all of the client's timing logic, so that
+// it can be replaced in tests. The only exceptions are the deadlines of
+// network connections, which the operating system compares to the system
+// time.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	Sleep(d time.Duration)
+	NewTimer(d time.Duration) timer
+}
+
+// timer is a single-use timer, like time.Timer.
+type timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+func (realClock) NewTimer(d time.Duration) timer         { return realTimer{time.NewTimer(d)} }
+
+type realTimer struct {
+	t *time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time { return t.t.C }
+func (t realTimer) Stop() bool          { return t.t.Stop() }
+
+// withClock makes the client use clk instead of the system clock.
+func withClock(clk clock) Option {
+	return func(c *Client) {
+		c.clock = clk
+	}
+}
+
+// withTimeout is like context.WithTimeout, but measures the timeout on the
+// client's clock. The context's error is context.Canceled once the timeout
+// expires on a clock other than the system clock, with context.DeadlineExceeded
+// as its cause.
+func (c *Client) withTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := c.clock.(realClock); ok {
+		return context.WithTimeout(ctx, d)
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	t := c.clock.NewTimer(d)
+	go func() {
+		select {
+		case <-t.C():
+			cancel(context.DeadlineExceeded)
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		t.Stop()
+		cancel(context.Canceled)
+	}
+}
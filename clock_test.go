@@ -0,0 +1,222 @@
+package signalr
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock whose time only moves when Advance is called.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clk *fakeClock
+	at  time.Time
+	c   chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) After(d time.Duration) <-chan time.Time { return f.NewTimer(d).C() }
+func (f *fakeClock) Sleep(d time.Duration)                  { <-f.After(d) }
+
+func (f *fakeClock) NewTimer(d time.Duration) timer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	t := &fakeTimer{clk: f, at: f.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		t.c <- f.now
+		return t
+	}
+	f.timers = append(f.timers, t)
+	return t
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Stop() bool {
+	t.clk.mu.Lock()
+	defer t.clk.mu.Unlock()
+
+	for i, other := range t.clk.timers {
+		if other == t {
+			t.clk.timers = append(t.clk.timers[:i], t.clk.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Advance moves the clock forward by d, firing the timers that expire.
+func (f *fakeClock) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.now = f.now.Add(d)
+	pending := f.timers[:0]
+	for _, t := range f.timers {
+		if t.at.After(f.now) {
+			pending = append(pending, t)
+			continue
+		}
+		t.c <- f.now
+	}
+	f.timers = pending
+}
+
+// waitTimers waits until n timers are pending, i.e. until the code under test
+// is waiting for the clock.
+func (f *fakeClock) waitTimers(t *testing.T, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		f.mu.Lock()
+		pending := len(f.timers)
+		f.mu.Unlock()
+		if pending == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d timers pending, want %d", pending, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWaitReconnectBacksOff(t *testing.T) {
+	clk := newFakeClock()
+	var delays []time.Duration
+	c := newClient("example.com", "1.5", "", withClock(clk), func(c *Client) {
+		c.MaxReconnectDelay = 40 * time.Second
+		c.OnReconnect = func(e ReconnectEvent) {
+			delays = append(delays, e.Delay)
+		}
+	})
+	defer c.Close()
+
+	want := []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second, 40 * time.Second}
+	for i, d := range want {
+		done := make(chan bool)
+		go func() {
+			done <- c.waitReconnect(i+1, clk.Now(), ErrConnectionLost)
+		}()
+
+		clk.waitTimers(t, 1)
+		clk.Advance(d - time.Millisecond)
+		select {
+		case <-done:
+			t.Fatalf("attempt %d: waited less than %v", i+1, d)
+		case <-time.After(10 * time.Millisecond):
+		}
+
+		clk.Advance(time.Millisecond)
+		if !<-done {
+			t.Fatalf("attempt %d: gave up", i+1)
+		}
+	}
+
+	if len(delays) != len(want) {
+		t.Fatalf("got %d OnReconnect calls, want %d", len(delays), len(want))
+	}
+	for i := range want {
+		if delays[i] != want[i] {
+			t.Errorf("attempt %d: delay %v, want %v", i+1, delays[i], want[i])
+		}
+	}
+}
+
+func TestReconnectDelayCapped(t *testing.T) {
+	tests := []struct {
+		max  time.Duration
+		want []time.Duration
+	}{
+		{0, []time.Duration{10 * time.Second, 10 * time.Second, 10 * time.Second}},
+		{2 * time.Second, []time.Duration{2 * time.Second, 2 * time.Second, 2 * time.Second}},
+		{15 * time.Second, []time.Duration{10 * time.Second, 15 * time.Second, 15 * time.Second}},
+	}
+
+	for _, tt := range tests {
+		c := newClient("example.com", "1.5", "", func(c *Client) {
+			c.MaxReconnectDelay = tt.max
+		})
+		defer c.Close()
+
+		for i, want := range tt.want {
+			if d := c.reconnectDelay(i + 1); d != want {
+				t.Errorf("MaxReconnectDelay %v, attempt %d: delay %v, want %v", tt.max, i+1, d, want)
+			}
+		}
+	}
+}
+
+func TestWaitReconnectGivesUp(t *testing.T) {
+	clk := newFakeClock()
+	c := newClient("example.com", "1.5", "", withClock(clk), func(c *Client) {
+		c.MaxReconnectDuration = time.Minute
+	})
+	defer c.Close()
+
+	since := clk.Now()
+	clk.Advance(55 * time.Second)
+	if c.waitReconnect(3, since, ErrConnectionLost) {
+		t.Fatal("kept reconnecting after MaxReconnectDuration")
+	}
+	if !errors.Is(c.LastError(), ErrReconnectTimeout) {
+		t.Errorf("LastError() = %v, want ErrReconnectTimeout", c.LastError())
+	}
+	if _, ok := <-c.Messages(); ok {
+		t.Error("messages channel not closed")
+	}
+}
+
+func TestWaitReconnectStopsOnClose(t *testing.T) {
+	clk := newFakeClock()
+	c := newClient("example.com", "1.5", "", withClock(clk))
+
+	done := make(chan bool)
+	go func() {
+		done <- c.waitReconnect(1, clk.Now(), ErrConnectionLost)
+	}()
+	clk.waitTimers(t, 1)
+
+	c.Close()
+	if <-done {
+		t.Error("waitReconnect() = true after Close")
+	}
+}
+
+func TestWithTimeout(t *testing.T) {
+	clk := newFakeClock()
+	c := newClient("example.com", "1.5", "", withClock(clk))
+	defer c.Close()
+
+	ctx, cancel := c.withTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	clk.waitTimers(t, 1)
+	clk.Advance(time.Second)
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("context not done after the timeout")
+	}
+	if !errors.Is(context.Cause(ctx), context.DeadlineExceeded) {
+		t.Errorf("cause = %v, want context.DeadlineExceeded", context.Cause(ctx))
+	}
+}
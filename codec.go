@@ -0,0 +1,100 @@
+package signalr
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/carterjones/helpers/trace"
+)
+
+// Codec marshals and unmarshals the messages exchanged with the server over
+// the websocket connection. It allows replacing encoding/json with a faster
+// implementation or with one configured differently.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSONCodec is a Codec backed by encoding/json. It is the default codec.
+type JSONCodec struct {
+	// UseNumber makes numbers decode into json.Number instead of float64
+	// when the destination is an interface{}, e.g. the hub method arguments
+	// in hubs.ClientMsg.A. This avoids losing precision on integers larger
+	// than 2^53.
+	UseNumber bool
+}
+
+// Marshal returns the JSON encoding of v.
+func (jc JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal parses the JSON-encoded data and stores the result in v.
+func (jc JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if jc.UseNumber {
+		dec.UseNumber()
+	}
+	return dec.Decode(v)
+}
+
+func (c *Client) codec() Codec {
+	if c.Codec == nil {
+		return JSONCodec{}
+	}
+	return c.Codec
+}
+
+// The shapes of the messages the server sends, used by checkFields to detect
+// fields the client doesn't know about.
+type (
+	messageFields struct {
+		C json.RawMessage
+		M []hubMessageFields
+		S json.RawMessage
+		G json.RawMessage
+		T json.RawMessage
+		D json.RawMessage
+	}
+
+	hubMessageFields struct {
+		I json.RawMessage
+		H json.RawMessage
+		M json.RawMessage
+		A json.RawMessage
+		S json.RawMessage
+	}
+
+	serverMsgFields struct {
+		I json.RawMessage
+		R json.RawMessage
+		E json.RawMessage
+		H json.RawMessage
+		D json.RawMessage
+		T json.RawMessage
+		S json.RawMessage
+		P *struct {
+			I json.RawMessage
+			D json.RawMessage
+		}
+	}
+)
+
+// checkFields reports on Errors if p, which was decoded into a message of the
+// given shape, has fields the client doesn't know about. It does nothing unless
+// DisallowUnknownFields is set.
+func (c *Client) checkFields(p []byte, shape interface{}) {
+	if !c.DisallowUnknownFields {
+		return
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(p))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(shape)
+	if err != nil {
+		err = fmt.Errorf("unexpected server message: %w", err)
+		trace.Error(err)
+		c.reportError(err)
+	}
+}
@@ -0,0 +1,191 @@
+package signalr
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/carterjones/helpers/trace"
+	"github.com/rdoorn/signalr/hubs"
+)
+
+// Handler handles a hub message sent by the server, i.e. the server calling a
+// client method.
+type Handler func(msg hubs.ClientMsg)
+
+// handlerSet holds the handlers registered for a hub method, along with the
+// hub and method names as they were registered.
+type handlerSet struct {
+	hub      string
+	method   string
+	handlers []Handler
+}
+
+// handlerKey returns the key of a hub method in the handler registry. The
+// server may use different casing for hub and method names than the client,
+// e.g. PascalCase instead of camelCase, so they are matched case-insensitively.
+func handlerKey(hub, method string) string {
+	return strings.ToLower(hub) + "." + strings.ToLower(method)
+}
+
+// On registers handler to be called for each message the server sends for the
+// given hub method, in addition to the handlers already registered for it.
+// Handlers are called one after another in the order they were registered, on
+// the read loop, so a handler sees the side effects of those before it. Since
+// functions can't be compared, registering the same function twice makes it
+// run twice per message; use Handle to register a hub method's only handler.
+// Hub and method names are matched case-insensitively.
+func (c *Client) On(hub, method string, handler Handler) {
+	c.handlersMu.Lock()
+	defer c.handlersMu.Unlock()
+
+	hs := c.handlerSet(hub, method)
+	hs.handlers = append(hs.handlers, handler)
+}
+
+// Handle registers handler as the only handler of the given hub method,
+// replacing any handlers registered before. Calling it again with the same
+// handler is harmless.
+func (c *Client) Handle(hub, method string, handler Handler) {
+	c.handlersMu.Lock()
+	defer c.handlersMu.Unlock()
+
+	hs := c.handlerSet(hub, method)
+	hs.handlers = []Handler{handler}
+}
+
+// handlerSet returns the handlers of a hub method, creating an empty set if
+// there are none. It must be called with handlersMu held.
+func (c *Client) handlerSet(hub, method string) *handlerSet {
+	if c.handlers == nil {
+		c.handlers = make(map[string]*handlerSet)
+	}
+
+	key := handlerKey(hub, method)
+	hs, ok := c.handlers[key]
+	if !ok {
+		hs = &handlerSet{hub: hub, method: method}
+		c.handlers[key] = hs
+	}
+	return hs
+}
+
+// Off removes all handlers registered for the given hub method.
+func (c *Client) Off(hub, method string) {
+	c.handlersMu.Lock()
+	defer c.handlersMu.Unlock()
+
+	delete(c.handlers, handlerKey(hub, method))
+}
+
+// Handlers reports the hub methods that currently have handlers registered,
+// as a map of hub names to sorted method names.
+func (c *Client) Handlers() map[string][]string {
+	c.handlersMu.RLock()
+	defer c.handlersMu.RUnlock()
+
+	hs := make(map[string][]string)
+	for _, set := range c.handlers {
+		hs[set.hub] = append(hs[set.hub], set.method)
+	}
+	for hub := range hs {
+		sort.Strings(hs[hub])
+	}
+	return hs
+}
+
+// dispatch calls the handlers registered for each hub message in msg. The
+// server may batch several hub messages into one persistent connection
+// message; each of them is dispatched on its own, in order.
+func (c *Client) dispatch(msg Message) {
+	for _, m := range msg.M {
+		c.mergeState(m.S)
+
+		var hs []Handler
+		c.handlersMu.RLock()
+		if set, ok := c.handlers[handlerKey(m.H, m.M)]; ok {
+			hs = set.handlers
+		}
+		c.handlersMu.RUnlock()
+
+		for _, h := range hs {
+			h(m)
+		}
+	}
+}
+
+// AddGroup registers a hub method call that joins a group, e.g.
+// c.AddGroup("chatHub", "JoinRoom", "room1"). Group membership is bound to the
+// connection, so the call is made on every (re)connect, as well as right away
+// if the client is connected.
+func (c *Client) AddGroup(hub, method string, args ...interface{}) (err error) {
+	m := hubs.ClientMsg{
+		H: hub,
+		M: method,
+		A: args,
+	}
+
+	c.handlersMu.Lock()
+	c.groups = append(c.groups, m)
+	c.handlersMu.Unlock()
+
+	if c.currentConn() == nil {
+		return
+	}
+
+	_, err = c.Send(m)
+	if err != nil {
+		trace.Error(err)
+		return
+	}
+	return
+}
+
+// rejoinGroups makes the group join calls registered with AddGroup on a new
+// connection. A call that fails, e.g. because of the rate limit, is reported
+// on Errors rather than failing the connection, which is usable without the
+// group; the others are still made.
+func (c *Client) rejoinGroups() {
+	c.handlersMu.RLock()
+	groups := append([]hubs.ClientMsg(nil), c.groups...)
+	c.handlersMu.RUnlock()
+
+	for _, m := range groups {
+		_, err := c.Send(m)
+		if err != nil {
+			trace.Error(err)
+			c.reportError(fmt.Errorf("rejoining group with %s.%s: %w", m.H, m.M, err))
+		}
+	}
+}
+
+// Reset clears the client's registries so that it can be reconfigured, e.g.
+// for a different user, without tearing down the connection: it removes all
+// handlers and the groups registered with AddGroup, clears the hub state and
+// the groups token, and fails the pending hub method calls with ErrReset.
+// Reading continues, so messages that arrive afterwards are still delivered
+// on the message channels, but find no handlers to dispatch to. Groups joined
+// on the current connection stay joined on the server, but aren't rejoined
+// when the client reconnects.
+func (c *Client) Reset() {
+	c.handlersMu.Lock()
+	c.handlers = nil
+	c.groups = nil
+	c.handlersMu.Unlock()
+
+	c.stateMu.Lock()
+	c.state = nil
+	c.stateMu.Unlock()
+
+	c.mu.Lock()
+	c.groupsToken = ""
+	c.mu.Unlock()
+
+	c.invokeMu.Lock()
+	defer c.invokeMu.Unlock()
+
+	for id, inv := range c.pending {
+		c.takePending(id)
+		inv.fail(ErrReset)
+	}
+}
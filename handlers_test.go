@@ -0,0 +1,180 @@
+package signalr
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rdoorn/signalr/hubs"
+)
+
+func TestDispatchBatchedHubMessages(t *testing.T) {
+	c := newClient("example.com", "1.5", "", func(c *Client) {
+		c.DeliveryPolicy = DeliverDrop
+	})
+	defer c.Close()
+
+	var got []string
+	c.On("chatHub", "joined", func(msg hubs.ClientMsg) {
+		got = append(got, msg.M+" "+msg.A[0].(string))
+	})
+	c.On("chatHub", "send", func(msg hubs.ClientMsg) {
+		got = append(got, msg.M+" "+msg.A[0].(string))
+	})
+
+	frame := `{"C":"d-2","M":[` +
+		`{"H":"ChatHub","M":"joined","A":["alice"]},` +
+		`{"H":"ChatHub","M":"send","A":["hi"]}]}`
+	err := c.handleFrame([]byte(frame), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"joined alice", "send hi"}
+	if len(got) != len(want) {
+		t.Fatalf("handlers called for %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("call %d: %s, want %s", i+1, got[i], want[i])
+		}
+	}
+}
+
+func TestHandlersAndGroupsSurviveReconnect(t *testing.T) {
+	s := newTestServer(t)
+	clk := newFakeClock()
+	c, conn := s.connected(withClock(clk), func(c *Client) {
+		c.DeliveryPolicy = DeliverDrop
+	})
+
+	got := make(chan string, 1)
+	c.On("chatHub", "send", func(msg hubs.ClientMsg) {
+		got <- msg.A[0].(string)
+	})
+	err := c.AddGroup("chatHub", "JoinRoom", "room1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cm := readInvocation(t, conn); cm.M != "JoinRoom" {
+		t.Fatalf("client called %s, want JoinRoom", cm.M)
+	}
+
+	conn.Close()
+	clk.waitTimers(t, 1)
+	clk.Advance(reconnectDelay)
+	conn = <-s.conns
+
+	// The group is joined again on the new connection...
+	if cm := readInvocation(t, conn); cm.M != "JoinRoom" || cm.A[0] != "room1" {
+		t.Fatalf("client called %s%v after reconnecting, want JoinRoom[room1]", cm.M, cm.A)
+	}
+
+	// ...and the handler still fires.
+	sendFrame(t, conn, `{"C":"d-2","M":[{"H":"chatHub","M":"send","A":["hi"]}]}`)
+	select {
+	case arg := <-got:
+		if arg != "hi" {
+			t.Errorf("handler called with %s, want hi", arg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler not called after reconnecting")
+	}
+}
+
+func TestDispatchIgnoresCase(t *testing.T) {
+	c := newClient("example.com", "1.5", "")
+	defer c.Close()
+
+	var camel, pascal int
+	c.On("chatHub", "broadcastMessage", func(msg hubs.ClientMsg) {
+		camel++
+	})
+	c.On("ChatHub", "BroadcastMessage", func(msg hubs.ClientMsg) {
+		pascal++
+	})
+
+	for _, m := range []hubs.ClientMsg{
+		{H: "chatHub", M: "broadcastMessage"},
+		{H: "ChatHub", M: "BroadcastMessage"},
+		{H: "CHATHUB", M: "broadcastmessage"},
+	} {
+		c.dispatch(Message{M: []hubs.ClientMsg{m}})
+	}
+
+	if camel != 3 || pascal != 3 {
+		t.Errorf("handlers called %d and %d times, want 3 each", camel, pascal)
+	}
+}
+
+func TestOnHandleOff(t *testing.T) {
+	c := newClient("example.com", "1.5", "")
+	defer c.Close()
+
+	var calls []string
+	handler := func(name string) Handler {
+		return func(msg hubs.ClientMsg) {
+			calls = append(calls, name)
+		}
+	}
+	call := func() []string {
+		calls = nil
+		c.dispatch(Message{M: []hubs.ClientMsg{{H: "chatHub", M: "send"}}})
+		return calls
+	}
+	check := func(what string, want ...string) {
+		t.Helper()
+		got := call()
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("%s: handlers %v called, want %v", what, got, want)
+		}
+	}
+
+	c.On("chatHub", "send", handler("first"))
+	c.On("chatHub", "send", handler("second"))
+	check("On appends, in order", "first", "second")
+
+	c.Handle("chatHub", "send", handler("only"))
+	check("Handle replaces", "only")
+
+	c.On("chatHub", "send", handler("added"))
+	check("On after Handle appends", "only", "added")
+
+	c.Off("chatHub", "send")
+	check("Off removes")
+	if hs := c.Handlers(); len(hs) != 0 {
+		t.Errorf("Handlers() = %v after Off", hs)
+	}
+}
+
+func TestRejoinFailureKeepsConnection(t *testing.T) {
+	s := newTestServer(t)
+	c := s.client(func(c *Client) {
+		c.MaxOutboundSize = 64
+	})
+	defer c.Close()
+
+	err := c.AddGroup("chatHub", "JoinRoom", strings.Repeat("x", 64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.init(context.Background())
+	if err != nil {
+		t.Fatalf("init() = %v, want the connection despite the failed rejoin", err)
+	}
+	<-s.conns
+
+	select {
+	case err = <-c.Errors():
+		if !errors.Is(err, ErrMessageTooLarge) {
+			t.Errorf("error %v reported, want ErrMessageTooLarge", err)
+		}
+	default:
+		t.Error("failed rejoin not reported")
+	}
+	if c.currentConn() == nil {
+		t.Error("connection dropped after the failed rejoin")
+	}
+}
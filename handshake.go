@@ -0,0 +1,99 @@
+package signalr
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/carterjones/helpers/trace"
+)
+
+// HandshakeError is returned when the server responds to one of the handshake
+// requests with an unexpected HTTP status.
+type HandshakeError struct {
+	// Step is the handshake step that failed, e.g. "negotiate" or "start".
+	Step string
+
+	// StatusCode is the HTTP status code returned by the server.
+	StatusCode int
+
+	// Location is the target of a redirect response, e.g. a login page,
+	// if NoNegotiateRedirects is set.
+	Location string
+}
+
+func (e *HandshakeError) Error() string {
+	msg := e.Step + " failed with HTTP status " + strconv.Itoa(e.StatusCode)
+	if e.Location != "" {
+		msg += ", redirected to " + e.Location
+	}
+	return msg
+}
+
+func unauthorized(statusCode int) bool {
+	return statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden
+}
+
+// handshakeClient returns the HTTP client for a handshake step. With
+// NoNegotiateRedirects, the negotiate request doesn't follow redirects; the
+// client is copied rather than changed, since it may be shared.
+func (c *Client) handshakeClient(step string) *http.Client {
+	if step != "negotiate" || !c.NoNegotiateRedirects {
+		return c.httpClient
+	}
+
+	hc := *c.httpClient
+	hc.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return &hc
+}
+
+// doHandshake performs a request to one of the handshake endpoints. If the
+// server rejects the credentials and OnUnauthorized is set, it calls
+// OnUnauthorized and retries the request once.
+func (c *Client) doHandshake(ctx context.Context, step, method, uri string, body []byte) (resp *http.Response, err error) {
+	for retried := false; ; retried = true {
+		var req *http.Request
+		req, err = c.newRequest(ctx, method, uri, body)
+		if err != nil {
+			trace.Error(err)
+			return
+		}
+
+		resp, err = c.handshakeClient(step).Do(req)
+		if err != nil {
+			trace.Error(err)
+			return
+		}
+
+		if !unauthorized(resp.StatusCode) {
+			return
+		}
+
+		c.discardResponse(step, resp)
+		derr := resp.Body.Close()
+		if derr != nil {
+			trace.Error(derr)
+		}
+
+		err = &HandshakeError{Step: step, StatusCode: resp.StatusCode}
+		resp = nil
+		if c.OnUnauthorized == nil || retried {
+			trace.Error(err)
+			return
+		}
+
+		err = c.OnUnauthorized(ctx)
+		if err != nil {
+			trace.Error(err)
+			return
+		}
+
+		err = c.refreshToken(ctx)
+		if err != nil {
+			trace.Error(err)
+			return
+		}
+	}
+}
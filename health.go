@@ -0,0 +1,66 @@
+package signalr
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/carterjones/helpers/trace"
+	"github.com/rdoorn/websocket"
+)
+
+// HealthCheck verifies that the server responds on the current connection by
+// sending a websocket ping and waiting for the pong, which a half-open
+// connection never delivers. It returns an error if the client isn't connected
+// or the pong doesn't arrive before ctx is done.
+func (c *Client) HealthCheck(ctx context.Context) (err error) {
+	conn := c.currentConn()
+	if conn == nil {
+		err = ErrNotConnected
+		return
+	}
+
+	c.pongMu.Lock()
+	c.pingSeq++
+	data := strconv.FormatUint(c.pingSeq, 10)
+	ch := make(chan struct{})
+	if c.pongs == nil {
+		c.pongs = make(map[string]chan struct{})
+	}
+	c.pongs[data] = ch
+	c.pongMu.Unlock()
+
+	defer func() {
+		c.pongMu.Lock()
+		delete(c.pongs, data)
+		c.pongMu.Unlock()
+	}()
+
+	// A zero deadline means no deadline.
+	deadline, _ := ctx.Deadline()
+	err = conn.WriteControl(websocket.PingMessage, []byte(data), deadline)
+	if err != nil {
+		trace.Error(err)
+		return
+	}
+
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+		return
+	case <-ch:
+		return
+	}
+}
+
+// handlePong is the pong handler of every connection. It is called by the read
+// loop.
+func (c *Client) handlePong(appData string) error {
+	c.pongMu.Lock()
+	defer c.pongMu.Unlock()
+
+	if ch, ok := c.pongs[appData]; ok {
+		close(ch)
+		delete(c.pongs, appData)
+	}
+	return nil
+}
@@ -7,6 +7,7 @@ package hubs
 import (
 	"encoding/json"
 	"errors"
+	"strconv"
 
 	"github.com/carterjones/helpers/trace"
 )
@@ -14,7 +15,7 @@ import (
 // ClientMsg represents a message sent to the Hubs API from the client.
 type ClientMsg struct {
 	// invocation identifier – allows to match up responses with requests
-	I int
+	I int64
 
 	// the name of the hub
 	H string
@@ -50,11 +51,11 @@ func (cm *ClientMsg) MarshalJSON() (buf []byte, err error) {
 	}
 
 	return json.Marshal(&struct {
-		I int
+		I int64
 		H string
 		M string
 		A []byte
-		S *json.RawMessage `json:"omitempty"`
+		S *json.RawMessage `json:"S,omitempty"`
 	}{
 		I: cm.I,
 		H: cm.H,
@@ -67,7 +68,7 @@ func (cm *ClientMsg) MarshalJSON() (buf []byte, err error) {
 // ServerMsg represents a message sent to the Hubs API from the server.
 type ServerMsg struct {
 	// invocation Id (always present)
-	I int
+	I int64
 
 	// the value returned by the server method (present if the method is not
 	// void)
@@ -90,4 +91,116 @@ type ServerMsg struct {
 
 	// state – a dictionary containing additional custom data (optional)
 	S *json.RawMessage `json:",omitempty"`
+
+	// progress update (present if the message reports the progress of a
+	// method rather than its result)
+	P *Progress `json:",omitempty"`
+}
+
+// Progress represents a progress update sent by a server method before its
+// result.
+type Progress struct {
+	// invocation Id
+	I json.Number
+
+	// the progress data
+	D json.RawMessage
+}
+
+// UnmarshalJSON populates the message from a JSON-formatted byte array. The
+// server echoes the invocation id as a string, so both strings and numbers are
+// accepted for the "I" field. Progress updates carry a prefixed id in "I", so
+// that old clients ignore them, and the actual id in "P"; for those, I is set
+// to the latter.
+func (sm *ServerMsg) UnmarshalJSON(data []byte) (err error) {
+	type serverMsg ServerMsg
+	aux := struct {
+		I json.RawMessage
+		*serverMsg
+	}{
+		serverMsg: (*serverMsg)(sm),
+	}
+
+	err = json.Unmarshal(data, &aux)
+	if err != nil {
+		trace.Error(err)
+		return
+	}
+
+	var id json.Number
+	if sm.P != nil {
+		id = sm.P.I
+	} else if aux.I != nil {
+		err = json.Unmarshal(aux.I, &id)
+		if err != nil {
+			trace.Error(err)
+			return
+		}
+	}
+
+	if id == "" {
+		return
+	}
+
+	sm.I, err = strconv.ParseInt(string(id), 10, 64)
+	if err != nil {
+		trace.Error(err)
+		return
+	}
+	return
+}
+
+// HubError is the error returned by a server hub method.
+type HubError struct {
+	// the error message
+	Message string
+
+	// true if the method threw a HubException, whose message and data are
+	// meant for the client, rather than failing unexpectedly
+	Hub bool
+
+	// additional error data attached to the HubException (optional)
+	Data json.RawMessage
+}
+
+// Error returns the error message sent by the server.
+func (e *HubError) Error() string {
+	return e.Message
+}
+
+// DataInto decodes the additional error data into v. It returns an error if
+// there is none.
+func (e *HubError) DataInto(v interface{}) (err error) {
+	if len(e.Data) == 0 {
+		err = errors.New("hub error has no data")
+		return
+	}
+
+	err = json.Unmarshal(e.Data, v)
+	if err != nil {
+		trace.Error(err)
+		return
+	}
+	return
+}
+
+// Result returns the value returned by the server method, or a *HubError if
+// the method failed. The result is empty for void methods.
+func (sm ServerMsg) Result() (result json.RawMessage, err error) {
+	if sm.E != nil {
+		he := &HubError{Message: *sm.E}
+		if sm.H != nil {
+			he.Hub = *sm.H
+		}
+		if sm.D != nil {
+			he.Data = *sm.D
+		}
+		err = he
+		return
+	}
+
+	if sm.R != nil {
+		result = *sm.R
+	}
+	return
 }
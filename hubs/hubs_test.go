@@ -0,0 +1,55 @@
+package hubs
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestServerMsgLargeID(t *testing.T) {
+	// 2^53 + 1 is the smallest integer a float64 can't represent.
+	const id = 1<<53 + 1
+
+	for _, data := range []string{
+		`{"I":"9007199254740993","R":1}`,
+		`{"I":9007199254740993,"R":1}`,
+	} {
+		var sm ServerMsg
+		err := json.Unmarshal([]byte(data), &sm)
+		if err != nil {
+			t.Fatalf("%s: %v", data, err)
+		}
+		if sm.I != id {
+			t.Errorf("%s: I = %d, want %d", data, sm.I, int64(id))
+		}
+	}
+}
+
+func TestClientMsgOmitsNilState(t *testing.T) {
+	state := json.RawMessage(`{"room":"lobby"}`)
+	for _, tt := range []struct {
+		name string
+		s    *json.RawMessage
+		want bool
+	}{
+		{"nil state", nil, false},
+		{"state", &state, true},
+	} {
+		m := ClientMsg{I: 1, H: "chathub", M: "send", S: tt.s}
+		data, err := json.Marshal(&m)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		var fields map[string]json.RawMessage
+		err = json.Unmarshal(data, &fields)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if _, ok := fields["omitempty"]; ok {
+			t.Errorf("%s: %s has an omitempty key", tt.name, data)
+		}
+		if _, ok := fields["S"]; ok != tt.want {
+			t.Errorf("%s: %s has S key: %v, want %v", tt.name, data, ok, tt.want)
+		}
+	}
+}
@@ -0,0 +1,494 @@
+package signalr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/carterjones/helpers/trace"
+	"github.com/rdoorn/signalr/hubs"
+)
+
+func (c *Client) nextInvocationID() (id int64) {
+	c.invokeMu.Lock()
+	defer c.invokeMu.Unlock()
+
+	id = c.invocationID
+	c.invocationID++
+	return
+}
+
+// invocation is a hub method call waiting for its result.
+type invocation struct {
+	result chan hubs.ServerMsg
+
+	// gen is the generation of the connection that was current when the
+	// invocation was made.
+	gen uint64
+
+	// err is the reason result was closed without a value. It is set
+	// before result is closed.
+	err error
+}
+
+// fail closes the result channel of inv without a value because of err. It
+// must be called with invokeMu held, after taking inv from pending.
+func (inv *invocation) fail(err error) {
+	inv.err = err
+	close(inv.result)
+}
+
+// addPending allocates a new invocation id and registers an invocation that
+// will receive the server's result for it. If MaxConcurrentInvokes is set, it
+// first waits for one of the pending invocations to complete if needed.
+func (c *Client) addPending(ctx context.Context) (id int64, inv *invocation, err error) {
+	if c.invokeSem != nil {
+		select {
+		case c.invokeSem <- struct{}{}:
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		case <-c.done:
+			err = ErrClosed
+			return
+		}
+	}
+
+	c.invokeMu.Lock()
+	defer c.invokeMu.Unlock()
+
+	id = c.invocationID
+	c.invocationID++
+
+	// Buffer the channel so the read loop never blocks on a caller that
+	// has already given up.
+	inv = &invocation{
+		result: make(chan hubs.ServerMsg, 1),
+		gen:    c.connGen.Load(),
+	}
+	c.pending[id] = inv
+	return
+}
+
+func (c *Client) removePending(id int64) {
+	c.invokeMu.Lock()
+	defer c.invokeMu.Unlock()
+
+	c.takePending(id)
+}
+
+// takePending removes the invocation with the given id from pending, freeing
+// its MaxConcurrentInvokes slot. It must be called with invokeMu held.
+func (c *Client) takePending(id int64) (inv *invocation, ok bool) {
+	inv, ok = c.pending[id]
+	if !ok {
+		return
+	}
+
+	delete(c.pending, id)
+	if c.invokeSem != nil {
+		<-c.invokeSem
+	}
+	return
+}
+
+// dispatchResult delivers p to the Invoke call waiting for it if p is a hub
+// method result. It reports whether p was a hub method result.
+func (c *Client) dispatchResult(p []byte) bool {
+	var probe struct {
+		I json.RawMessage
+	}
+	err := c.codec().Unmarshal(p, &probe)
+	if err != nil || probe.I == nil {
+		return false
+	}
+
+	var sm hubs.ServerMsg
+	err = c.codec().Unmarshal(p, &sm)
+	if err != nil {
+		trace.Error(err)
+		c.reportError(err)
+		return true
+	}
+	c.checkFields(p, &serverMsgFields{})
+
+	c.mergeState(sm.S)
+
+	if sm.P != nil {
+		c.dispatchProgress(sm.I, sm.P.D)
+		return true
+	}
+
+	c.invokeMu.Lock()
+	inv, ok := c.takePending(sm.I)
+	c.invokeMu.Unlock()
+
+	if !ok {
+		trace.DebugMessage("[signalR.dispatchResult] No pending invocation for result")
+		return true
+	}
+
+	inv.result <- sm
+	return true
+}
+
+// failPending fails all pending invocations by closing their channels. It is
+// called when the client disconnects, since their results will never arrive.
+func (c *Client) failPending() {
+	c.failPendingUntil(^uint64(0))
+}
+
+// failPendingUntil fails the pending invocations made on connections up to
+// generation gen, when the connection of that generation is lost. Invocations
+// made on a newer connection, which may already be established by then, are
+// left alone. Invocation ids are never reused, so a late result of a failed
+// invocation can't be mistaken for that of a newer one.
+func (c *Client) failPendingUntil(gen uint64) {
+	c.invokeMu.Lock()
+	defer c.invokeMu.Unlock()
+
+	for id, inv := range c.pending {
+		if inv.gen > gen {
+			continue
+		}
+		c.takePending(id)
+		inv.fail(ErrConnectionLost)
+	}
+}
+
+// PendingInvocations returns the ids of the hub method calls waiting for their
+// results, in ascending order.
+func (c *Client) PendingInvocations() (ids []int64) {
+	c.invokeMu.Lock()
+	defer c.invokeMu.Unlock()
+
+	for id := range c.pending {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return
+}
+
+// CancelInvocation stops waiting for the result of a hub method call. The call
+// fails with ErrInvocationCanceled, and its result is ignored if it arrives
+// later. The server is not told, so the method still runs to completion.
+func (c *Client) CancelInvocation(id int64) {
+	c.invokeMu.Lock()
+	defer c.invokeMu.Unlock()
+
+	if inv, ok := c.takePending(id); ok {
+		inv.fail(ErrInvocationCanceled)
+	}
+}
+
+// SendAsync calls a method on a server hub without waiting for its result. It
+// returns the invocation id and a channel that receives the server's result,
+// or is closed without a value if the connection is lost or the call is
+// canceled first.
+func (c *Client) SendAsync(hub, method string, args ...interface{}) (id int64, result <-chan hubs.ServerMsg, err error) {
+	id, inv, err := c.sendAsync(context.Background(), hub, method, args...)
+	if err != nil {
+		return
+	}
+
+	result = inv.result
+	return
+}
+
+func (c *Client) sendAsync(ctx context.Context, hub, method string, args ...interface{}) (id int64, inv *invocation, err error) {
+	id, inv, err = c.addPending(ctx)
+	if err != nil {
+		trace.Error(err)
+		return
+	}
+
+	err = c.send(ctx, hubs.ClientMsg{
+		I: id,
+		H: hub,
+		M: method,
+		A: args,
+	})
+	if err != nil {
+		trace.Error(err)
+		c.removePending(id)
+		inv = nil
+		return
+	}
+	return
+}
+
+// SetMethodTimeout sets the default timeout of Invoke calls to a hub method.
+// It applies when the caller's context has no deadline, and takes precedence
+// over InvokeTimeout.
+func (c *Client) SetMethodTimeout(hub, method string, d time.Duration) {
+	c.invokeMu.Lock()
+	defer c.invokeMu.Unlock()
+
+	if c.methodTimeouts == nil {
+		c.methodTimeouts = make(map[string]time.Duration)
+	}
+	c.methodTimeouts[hub+"."+method] = d
+}
+
+func (c *Client) invokeTimeout(hub, method string) time.Duration {
+	c.invokeMu.Lock()
+	defer c.invokeMu.Unlock()
+
+	if d, ok := c.methodTimeouts[hub+"."+method]; ok {
+		return d
+	}
+	return c.InvokeTimeout
+}
+
+// Invoke calls a method on a server hub and waits for its result. The result
+// is empty for methods that do not return a value. If ctx has no deadline, the
+// method's timeout set with SetMethodTimeout, or else InvokeTimeout, applies.
+// If the method fails, the error wraps a *hubs.HubError.
+func (c *Client) Invoke(ctx context.Context, hub, method string, args ...interface{}) (result json.RawMessage, err error) {
+	if _, ok := ctx.Deadline(); !ok {
+		if d := c.invokeTimeout(hub, method); d > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = c.withTimeout(ctx, d)
+			defer cancel()
+		}
+	}
+
+	id, inv, err := c.sendAsync(ctx, hub, method, args...)
+	if err != nil {
+		trace.Error(err)
+		return
+	}
+	defer c.removePending(id)
+
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+		return
+	case sm, ok := <-inv.result:
+		if !ok {
+			err = inv.err
+			return
+		}
+		result, err = sm.Result()
+		if err != nil {
+			err = fmt.Errorf("hub method %s.%s failed: %w", hub, method, err)
+			return
+		}
+		return
+	}
+}
+
+// InvokeReliable calls a method on a server hub like Invoke, but if the
+// connection is lost before the result arrives, it waits for the client to
+// reconnect and calls the method again, up to ReliableRetries times. The method
+// may thus run more than once (at-least-once delivery), so it should be
+// idempotent. ctx bounds the whole call, including the waits for reconnects.
+func (c *Client) InvokeReliable(ctx context.Context, hub, method string, args ...interface{}) (result json.RawMessage, err error) {
+	retries := c.ReliableRetries
+	if retries == 0 {
+		retries = 3
+	}
+
+	for attempt := 0; ; attempt++ {
+		err = c.waitConnected(ctx)
+		if err != nil {
+			trace.Error(err)
+			return
+		}
+
+		result, err = c.Invoke(ctx, hub, method, args...)
+		if err == nil || attempt == retries {
+			return
+		}
+		if !errors.Is(err, ErrConnectionLost) && !errors.Is(err, ErrNotConnected) {
+			return
+		}
+		trace.DebugMessage("[signalR.InvokeReliable] Connection lost, resending after reconnect")
+	}
+}
+
+// InvokeTyped calls a method on a server hub like Invoke, and decodes the
+// result into a value of type T.
+func InvokeTyped[T any](ctx context.Context, c *Client, hub, method string, args ...interface{}) (v T, err error) {
+	result, err := c.Invoke(ctx, hub, method, args...)
+	if err != nil {
+		return
+	}
+
+	err = c.codec().Unmarshal(result, &v)
+	if err != nil {
+		trace.Error(err)
+		var zero T
+		v = zero
+		return
+	}
+	return
+}
+
+// stream receives the progress updates of an InvokeStream call.
+type stream struct {
+	progress chan json.RawMessage
+
+	// quit is closed when the caller stops listening.
+	quit chan struct{}
+}
+
+// dispatchProgress delivers a progress update to the InvokeStream call waiting
+// for it, if any.
+func (c *Client) dispatchProgress(id int64, data json.RawMessage) {
+	c.invokeMu.Lock()
+	s, ok := c.streams[id]
+	c.invokeMu.Unlock()
+
+	if !ok {
+		trace.DebugMessage("[signalR.dispatchProgress] No stream for progress update")
+		return
+	}
+
+	select {
+	case s.progress <- data:
+	case <-s.quit:
+	case <-c.done:
+	}
+}
+
+// InvokeStream calls a method on a server hub that reports its progress, e.g.
+// through an IProgress<T> parameter, and returns a channel that receives each
+// progress update followed by the method's result, if any. The channel is
+// closed when the method completes or ctx is canceled. If the method fails or
+// the connection is lost, the channel is closed and the error is reported on
+// Errors.
+func (c *Client) InvokeStream(ctx context.Context, hub, method string, args ...interface{}) (results <-chan json.RawMessage, err error) {
+	s := &stream{
+		progress: make(chan json.RawMessage, c.MessageBuffer),
+		quit:     make(chan struct{}),
+	}
+
+	// Register the stream before sending, so that no progress update can
+	// arrive before it.
+	id, inv, err := c.addPending(ctx)
+	if err != nil {
+		trace.Error(err)
+		return
+	}
+	c.invokeMu.Lock()
+	c.streams[id] = s
+	c.invokeMu.Unlock()
+
+	removeStream := func() {
+		c.invokeMu.Lock()
+		delete(c.streams, id)
+		c.invokeMu.Unlock()
+		close(s.quit)
+	}
+
+	err = c.send(ctx, hubs.ClientMsg{
+		I: id,
+		H: hub,
+		M: method,
+		A: args,
+	})
+	if err != nil {
+		trace.Error(err)
+		c.removePending(id)
+		removeStream()
+		return
+	}
+
+	out := make(chan json.RawMessage)
+	started := c.goroutine(func() {
+		defer close(out)
+		defer c.removePending(id)
+		defer removeStream()
+
+		forward := func(data json.RawMessage) bool {
+			select {
+			case out <- data:
+				return true
+			case <-ctx.Done():
+				return false
+			case <-c.done:
+				return false
+			}
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case data := <-s.progress:
+				if !forward(data) {
+					return
+				}
+			case sm, ok := <-inv.result:
+				// Updates sent before the result may still be
+				// buffered.
+				for len(s.progress) > 0 {
+					if !forward(<-s.progress) {
+						return
+					}
+				}
+
+				if !ok {
+					if inv.err != ErrInvocationCanceled {
+						c.reportError(inv.err)
+					}
+					return
+				}
+
+				r, err := sm.Result()
+				if err != nil {
+					c.reportError(fmt.Errorf("hub method %s.%s failed: %w", hub, method, err))
+					return
+				}
+				if r != nil {
+					forward(r)
+				}
+				return
+			}
+		}
+	})
+	if !started {
+		c.removePending(id)
+		removeStream()
+		close(out)
+	}
+
+	results = out
+	return
+}
+
+// InvokeOnce connects to the server, calls a method on a server hub, waits for
+// its result and disconnects. It suits scripts and health checks that only
+// make a single call; messages other than the result are discarded.
+func InvokeOnce(ctx context.Context, host, protocol, connectionData, hub, method string, args ...interface{}) (result json.RawMessage, err error) {
+	c := newClient(host, protocol, connectionData, func(c *Client) {
+		c.DeliveryPolicy = DeliverDrop
+	})
+	defer func() {
+		cerr := c.Close()
+		if cerr != nil {
+			trace.Error(cerr)
+		}
+	}()
+
+	err = c.init(ctx)
+	if err != nil {
+		trace.Error(err)
+		return
+	}
+
+	c.goroutine(func() {
+		_, gen := c.currentConnGen()
+		rerr := c.readMessages()
+		c.failPendingUntil(gen)
+		if rerr != nil && !c.closed() {
+			trace.Error(rerr)
+		}
+	})
+
+	return c.Invoke(ctx, hub, method, args...)
+}
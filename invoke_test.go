@@ -0,0 +1,212 @@
+package signalr
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rdoorn/websocket"
+)
+
+func TestDispatchResultLargeID(t *testing.T) {
+	c := newClient("example.com", "1.5", "")
+	defer c.Close()
+
+	// Ids that a float64 can't tell apart.
+	c.invocationID = 1 << 53
+	first, firstInv, err := c.addPending(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, secondInv, err := c.addPending(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second != 1<<53+1 {
+		t.Fatalf("second id = %d, want %d", second, int64(1<<53+1))
+	}
+
+	if !c.dispatchResult([]byte(`{"I":"9007199254740993","R":42}`)) {
+		t.Fatal("result not recognized")
+	}
+
+	select {
+	case sm := <-secondInv.result:
+		if string(*sm.R) != "42" {
+			t.Errorf("result = %s, want 42", *sm.R)
+		}
+	default:
+		t.Fatalf("result not delivered to invocation %d", second)
+	}
+	select {
+	case sm := <-firstInv.result:
+		t.Errorf("result for invocation %d delivered to invocation %d", sm.I, first)
+	default:
+	}
+}
+
+func TestCloseWithUnreadStream(t *testing.T) {
+	s := newTestServer(t)
+	c, conn := s.connected()
+
+	_, err := c.InvokeStream(context.Background(), "chathub", "count")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm := readInvocation(t, conn)
+
+	// Nobody reads the results, so forwarding the first update blocks. The
+	// stream is unbuffered, so once the second one was received, the first
+	// one is being forwarded.
+	for i := 1; i <= 2; i++ {
+		sendFrame(t, conn, fmt.Sprintf(`{"I":"P|%d","P":{"I":"%d","D":%d}}`, cm.I, cm.I, i))
+	}
+	waitFor(t, "both updates to be received", func() bool {
+		return c.Stats().TotalMessagesReceived == 2
+	})
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- c.Close()
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close blocked on an unread stream")
+	}
+}
+
+type room struct {
+	Name  string
+	Users int
+}
+
+// invokeTyped calls InvokeTyped, answering the call with result on the server
+// side of the connection.
+func invokeTyped[T any](t *testing.T, c *Client, conn *websocket.Conn, result string) (T, error) {
+	t.Helper()
+
+	type typed struct {
+		v   T
+		err error
+	}
+	done := make(chan typed, 1)
+	go func() {
+		v, err := InvokeTyped[T](context.Background(), c, "chathub", "get")
+		done <- typed{v, err}
+	}()
+	respond(t, conn, result)
+	r := <-done
+	return r.v, r.err
+}
+
+func TestInvokeTyped(t *testing.T) {
+	s := newTestServer(t)
+	c, conn := s.connected()
+
+	r, err := invokeTyped[room](t, c, conn, `{"Name":"lobby","Users":3}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != (room{Name: "lobby", Users: 3}) {
+		t.Errorf("struct result = %+v", r)
+	}
+
+	names, err := invokeTyped[[]string](t, c, conn, `["lobby","games"]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 || names[0] != "lobby" || names[1] != "games" {
+		t.Errorf("slice result = %v", names)
+	}
+
+	n, err := invokeTyped[int](t, c, conn, `42`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 42 {
+		t.Errorf("primitive result = %d, want 42", n)
+	}
+
+	// A result of the wrong type is an error, with the zero value.
+	r, err = invokeTyped[room](t, c, conn, `{"Name":"lobby","Users":"many"}`)
+	if err == nil {
+		t.Error("result of the wrong type decoded without error")
+	}
+	if r != (room{}) {
+		t.Errorf("result = %+v along with error, want the zero value", r)
+	}
+}
+
+func TestFailPendingWhileInvoking(t *testing.T) {
+	c := newClient("example.com", "1.5", "")
+	defer c.Close()
+
+	type call struct {
+		id  int64
+		inv *invocation
+	}
+	const workers, perWorker = 8, 100
+	calls := make(chan call, workers*perWorker)
+
+	// Connections come and go while invocations are made and their results
+	// arrive.
+	stop := make(chan struct{})
+	churned := make(chan struct{})
+	go func() {
+		defer close(churned)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			gen := c.connGen.Add(1) - 1
+			c.failPendingUntil(gen)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				id, inv, err := c.addPending(context.Background())
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				c.dispatchResult([]byte(fmt.Sprintf(`{"I":"%d","R":%d}`, id, id)))
+				calls <- call{id, inv}
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	<-churned
+	close(calls)
+
+	seen := make(map[int64]bool)
+	for call := range calls {
+		if seen[call.id] {
+			t.Fatalf("id %d used twice", call.id)
+		}
+		seen[call.id] = true
+
+		// Each call either got its own result or failed because its
+		// connection was lost, never both or another call's result.
+		sm, ok := <-call.inv.result
+		switch {
+		case ok && sm.I != call.id:
+			t.Errorf("call %d got the result of call %d", call.id, sm.I)
+		case !ok && call.inv.err != ErrConnectionLost:
+			t.Errorf("call %d failed with %v", call.id, call.inv.err)
+		}
+	}
+	if ids := c.PendingInvocations(); len(ids) != 0 {
+		t.Errorf("calls %v still pending", ids)
+	}
+}
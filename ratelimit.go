@@ -0,0 +1,74 @@
+package signalr
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket limiting the rate of outbound messages.
+type rateLimiter struct {
+	clock clock
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(clk clock, rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		clock:  clk,
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   clk.Now(),
+	}
+}
+
+// take takes n tokens if they are available, and otherwise returns how long
+// it takes until they are.
+func (l *rateLimiter) take(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.clock.Now()
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+
+	// Never wait for more tokens than the bucket holds. A batch of more
+	// messages than that is let through once the bucket is full, but still
+	// charged for every message: the bucket goes into debt, which later
+	// messages wait for.
+	need := math.Min(float64(n), l.burst)
+	if l.tokens >= need {
+		l.tokens -= float64(n)
+		return 0
+	}
+	return time.Duration((need - l.tokens) / l.rate * float64(time.Second))
+}
+
+// wait takes n tokens, waiting for them to become available unless failFast
+// is set, in which case it returns ErrRateLimited.
+func (l *rateLimiter) wait(ctx context.Context, n int, failFast bool) error {
+	for {
+		d := l.take(n)
+		if d == 0 {
+			return nil
+		}
+		if failFast {
+			return ErrRateLimited
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-l.clock.After(d):
+		}
+	}
+}
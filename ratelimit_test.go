@@ -0,0 +1,48 @@
+package signalr
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterRefills(t *testing.T) {
+	clk := newFakeClock()
+	l := newRateLimiter(clk, 10, 2)
+
+	for i := 0; i < 2; i++ {
+		if d := l.take(1); d != 0 {
+			t.Fatalf("take %d within the burst: wait %v", i+1, d)
+		}
+	}
+	if d := l.take(1); d != 100*time.Millisecond {
+		t.Fatalf("take beyond the burst: wait %v, want 100ms", d)
+	}
+
+	clk.Advance(100 * time.Millisecond)
+	if d := l.take(1); d != 0 {
+		t.Fatalf("take after refill: wait %v", d)
+	}
+}
+
+func TestRateLimiterChargesLargeBatches(t *testing.T) {
+	clk := newFakeClock()
+	l := newRateLimiter(clk, 10, 5)
+
+	// A batch larger than the burst goes through on a full bucket...
+	if d := l.take(25); d != 0 {
+		t.Fatalf("batch on a full bucket: wait %v", d)
+	}
+
+	// ...but the next message waits until all of it is paid for.
+	if d := l.take(1); d != 2100*time.Millisecond {
+		t.Fatalf("take after batch: wait %v, want 2.1s", d)
+	}
+	clk.Advance(2 * time.Second)
+	if d := l.take(1); d == 0 {
+		t.Fatal("take before the batch was paid for didn't wait")
+	}
+	clk.Advance(100 * time.Millisecond)
+	if d := l.take(1); d != 0 {
+		t.Fatalf("take after the batch was paid for: wait %v", d)
+	}
+}
@@ -0,0 +1,320 @@
+package signalr
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rdoorn/signalr/hubs"
+	"github.com/rdoorn/websocket"
+)
+
+// TestMain makes the websocket dialer, which verifies certificates against
+// the system roots, trust the test servers. They all share one certificate.
+func TestMain(m *testing.M) {
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	f, err := os.CreateTemp("", "signalr-test-*.pem")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	err = pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err == nil {
+		err = f.Close()
+	}
+	srv.Close()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Setenv("SSL_CERT_FILE", f.Name())
+
+	code := m.Run()
+	os.Remove(f.Name())
+	os.Exit(code)
+}
+
+// testServer is a minimal SignalR server. It completes the handshake of every
+// client and hands the server side of each websocket connection to the test.
+type testServer struct {
+	*httptest.Server
+	t testing.TB
+
+	// addr, if set, is the address the server listens on, and http2 enables
+	// HTTP/2 for the handshake requests. keepAlive is the
+	// KeepAliveTimeout in the negotiate response, in seconds. rejectConnect,
+	// if set, is the status code of the response to websocket handshakes.
+	// negotiateMethod, if set, is the only method the negotiate endpoint
+	// allows.
+	addr            string
+	http2           bool
+	keepAlive       float64
+	rejectConnect   int
+	negotiateMethod string
+
+	// conns receives the server side of each connection, after the init
+	// message was sent on it. Like a real server, the test server only sends
+	// it on new connections, not on reconnected ones.
+	conns chan *websocket.Conn
+
+	mu       sync.Mutex
+	requests []request
+	aborts   []string
+	open     []*websocket.Conn
+}
+
+// request is a request received by a test server.
+type request struct {
+	Method string
+	Proto  int
+	Path   string
+	Host   string
+	Query  url.Values
+	Header http.Header
+	Body   string
+}
+
+// newTestServer starts a test server, configured by the opts.
+func newTestServer(t testing.TB, opts ...func(s *testServer)) *testServer {
+	s := &testServer{
+		t:     t,
+		conns: make(chan *websocket.Conn, 16),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/signalr/negotiate", s.negotiate)
+	mux.HandleFunc("/signalr/connect", s.connect)
+	mux.HandleFunc("/signalr/reconnect", s.connect)
+	mux.HandleFunc("/signalr/start", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"Response":"started"}`)
+	})
+	mux.HandleFunc("/signalr/abort", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.aborts = append(s.aborts, r.URL.Query().Get("connectionData"))
+		s.mu.Unlock()
+	})
+	s.Server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		s.mu.Lock()
+		s.requests = append(s.requests, request{
+			Method: r.Method,
+			Proto:  r.ProtoMajor,
+			Path:   r.URL.Path,
+			Host:   r.Host,
+			Query:  r.URL.Query(),
+			Header: r.Header.Clone(),
+			Body:   string(body),
+		})
+		s.mu.Unlock()
+		mux.ServeHTTP(w, r)
+	}))
+	if s.addr != "" {
+		l, err := net.Listen("tcp", s.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Listener.Close()
+		s.Listener = l
+	}
+	s.EnableHTTP2 = s.http2
+	s.StartTLS()
+
+	t.Cleanup(func() {
+		s.mu.Lock()
+		for _, conn := range s.open {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		s.Close()
+	})
+	return s
+}
+
+func (s *testServer) negotiate(w http.ResponseWriter, r *http.Request) {
+	if s.negotiateMethod != "" && r.Method != s.negotiateMethod {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	json.NewEncoder(w).Encode(NegotiateResponse{
+		URL:               "/signalr",
+		ConnectionToken:   "token",
+		ConnectionID:      "id",
+		KeepAliveTimeout:  s.keepAlive,
+		DisconnectTimeout: 30,
+		TryWebSockets:     true,
+		ProtocolVersion:   "1.5",
+	})
+}
+
+func (s *testServer) connect(w http.ResponseWriter, r *http.Request) {
+	if s.rejectConnect != 0 {
+		http.Error(w, "rejected", s.rejectConnect)
+		return
+	}
+
+	// Like most servers, the upgrader rejects handshakes whose Origin
+	// doesn't match the host, responding with the error itself. It accepts
+	// compression if the client offers it.
+	upgrader := websocket.Upgrader{EnableCompression: true}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.open = append(s.open, conn)
+	s.mu.Unlock()
+
+	if r.URL.Path == "/signalr/connect" {
+		err = conn.WriteMessage(websocket.TextMessage, []byte(`{"C":"d-1","S":1,"M":[]}`))
+		if err != nil {
+			s.t.Error(err)
+			return
+		}
+	}
+	s.conns <- conn
+}
+
+// host returns the host the clients connect to.
+func (s *testServer) host() string {
+	return s.Listener.Addr().String()
+}
+
+// client creates a client for the server, without connecting it.
+func (s *testServer) client(opts ...Option) *Client {
+	opts = append([]Option{func(c *Client) {
+		c.HTTPClient = s.Client()
+	}}, opts...)
+	return newClient(s.host(), "1.5", `[{"name":"chathub"}]`, opts...)
+}
+
+// connected creates a client connected to the server through its
+// ConnectLoop, and returns it along with the server side of the connection.
+func (s *testServer) connected(opts ...Option) (*Client, *websocket.Conn) {
+	s.t.Helper()
+
+	opts = append([]Option{func(c *Client) {
+		c.HTTPClient = s.Client()
+	}}, opts...)
+	nr := NegotiateResponse{
+		URL:               "/signalr",
+		ConnectionToken:   "token",
+		ConnectionID:      "id",
+		DisconnectTimeout: 30,
+		ProtocolVersion:   "1.5",
+	}
+	c, err := NewWithNegotiateResponse(s.host(), "1.5", `[{"name":"chathub"}]`, nr, opts...)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	s.t.Cleanup(func() {
+		c.Close()
+	})
+	return c, <-s.conns
+}
+
+// received returns the requests received for path, e.g. "/signalr/connect".
+func (s *testServer) received(path string) []request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var rs []request
+	for _, r := range s.requests {
+		if r.Path == path {
+			rs = append(rs, r)
+		}
+	}
+	return rs
+}
+
+// abortedWith returns the connection data of the abort requests received.
+func (s *testServer) abortedWith() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.aborts...)
+}
+
+// waitFor waits until cond holds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// readInvocation reads the next hub method call the client sent on the server
+// side of a connection.
+func readInvocation(t *testing.T, conn *websocket.Conn) hubs.ClientMsg {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, p, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cm hubs.ClientMsg
+	err = json.Unmarshal(p, &cm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cm
+}
+
+// respond answers the next hub method call the client sends with result.
+func respond(t *testing.T, conn *websocket.Conn, result string) {
+	t.Helper()
+
+	cm := readInvocation(t, conn)
+	sendFrame(t, conn, fmt.Sprintf(`{"I":"%d","R":%s}`, cm.I, result))
+}
+
+// discard reads and discards everything the client sends on the server side
+// of a connection, until the connection is closed.
+func discard(conn *websocket.Conn) {
+	go func() {
+		for {
+			_, r, err := conn.NextReader()
+			if err != nil {
+				return
+			}
+			_, err = io.Copy(io.Discard, r)
+			if err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// sendFrame writes a frame to the client on the server side of a connection.
+func sendFrame(t testing.TB, conn *websocket.Conn, frame string) {
+	t.Helper()
+
+	err := conn.WriteMessage(websocket.TextMessage, []byte(frame))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
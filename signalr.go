@@ -5,14 +5,28 @@
 package signalr
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"iter"
 	"log"
+	"log/slog"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/carterjones/helpers/trace"
@@ -23,9 +37,32 @@ import (
 
 const (
 	serverInitialized = 1
+
+	// errorsBuffer is the capacity of the errors channel.
+	errorsBuffer = 16
+
+	// transportWebSockets is the name of the websocket transport. It is the
+	// only transport the client implements.
+	transportWebSockets = "webSockets"
+
+	// reconnectDelay is the time to wait before each reconnect attempt.
+	reconnectDelay = 10 * time.Second
+
+	// closeTimeout bounds sending the close frame and the abort request.
+	closeTimeout = time.Second
+
+	// defaultInitTimeout bounds waiting for the init message if InitTimeout
+	// isn't set.
+	defaultInitTimeout = 30 * time.Second
+
+	// defaultCompressionThreshold is the size in bytes from which frames are
+	// compressed if CompressionThreshold isn't set.
+	defaultCompressionThreshold = 1024
 )
 
-type negotiateResponse struct {
+// NegotiateResponse is the server's response to the negotiate request. The
+// timeouts are in seconds.
+type NegotiateResponse struct {
 	URL                     string `json:"Url"`
 	ConnectionToken         string
 	ConnectionID            string `json:"ConnectionId"`
@@ -36,23 +73,109 @@ type negotiateResponse struct {
 	ProtocolVersion         string
 	TransportConnectTimeout float64
 	LongPollDelay           float64
+
+	// RedirectURL and AccessToken are set by services that hand the
+	// connection off to another endpoint, e.g. Azure SignalR Service. The
+	// client negotiates again at RedirectURL, authenticating with
+	// AccessToken.
+	RedirectURL string `json:"RedirectUrl"`
+	AccessToken string
+
+	// host and query locate the endpoint that issued the response, after
+	// following any redirects.
+	host  string
+	query string
 }
 
 type startResponse struct {
 	Response string
 }
 
-func (nr *negotiateResponse) connectionTokenEscaped() string {
+type pingResponse struct {
+	Response string
+}
+
+func (nr *NegotiateResponse) connectionTokenEscaped() string {
 	return url.QueryEscape(nr.ConnectionToken)
 }
 
+// seconds converts a timeout in seconds, as sent by the server, to a duration.
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+var (
+	// ErrNotConnected is returned when writing while the client has no
+	// websocket connection.
+	ErrNotConnected = errors.New("not connected")
+
+	// ErrMessageTooLarge is returned when writing a message larger than
+	// MaxOutboundSize.
+	ErrMessageTooLarge = errors.New("message exceeds the maximum outbound size")
+
+	// ErrServerReconnect ends a connection whose server told the client to
+	// reconnect. The client then reconnects like after a lost connection.
+	ErrServerReconnect = errors.New("server requested reconnect")
+
+	// ErrServerDisconnect ends a connection whose server told the client to
+	// disconnect. The client then gives up, like after one of the
+	// NonRetryableCloseCodes, and LastError returns it.
+	ErrServerDisconnect = errors.New("server requested disconnect")
+
+	// ErrConnectionLost is returned for invocations whose result can't
+	// arrive because the connection was lost.
+	ErrConnectionLost = errors.New("connection lost")
+
+	// ErrRateLimited is returned when RateLimitFailFast is set and sending
+	// would exceed the rate limit.
+	ErrRateLimited = errors.New("outbound rate limit exceeded")
+
+	// ErrClosed is returned when a connection completes after the client
+	// was closed.
+	ErrClosed = errors.New("client is closed")
+
+	// ErrKeepAliveTimeout is the reason for a reconnect when nothing, not
+	// even a keep-alive, was received from the server within the keep-alive
+	// timeout.
+	ErrKeepAliveTimeout = errors.New("no keep-alive received from server")
+
+	// ErrReconnectTimeout is the reason the client gave up reconnecting once
+	// MaxReconnectDuration passed.
+	ErrReconnectTimeout = errors.New("gave up reconnecting")
+
+	// ErrInvocationCanceled is returned by hub method calls canceled with
+	// CancelInvocation.
+	ErrInvocationCanceled = errors.New("invocation canceled")
+
+	// ErrWriteQueueFull is returned when a write would exceed
+	// MaxPendingWrites.
+	ErrWriteQueueFull = errors.New("write queue is full")
+
+	// ErrReset is returned by hub method calls pending when Reset was
+	// called.
+	ErrReset = errors.New("client was reset")
+
+	// ErrWriteTimeout is returned when a write doesn't complete within
+	// WriteTimeout.
+	ErrWriteTimeout = errors.New("write timed out")
+
+	// ErrAutoReconnect is returned by Reconnect unless DisableAutoReconnect
+	// is set, since ConnectLoop then reconnects on its own.
+	ErrAutoReconnect = errors.New("client reconnects automatically")
+
+	// ErrStopped is returned by Reconnect while the client is stopped, since
+	// only Restart resumes it.
+	ErrStopped = errors.New("client is stopped")
+)
+
 // Message represents a message sent from the server to the persistent websocket
 // connection.
 type Message struct {
 	// message id, present for all non-KeepAlive messages
 	C string
 
-	// an array containing actual data
+	// an array containing actual data; the server may batch several hub
+	// messages into a single persistent connection message
 	M []hubs.ClientMsg
 
 	// indicates that the transport was initialized (a.k.a. init message)
@@ -60,41 +183,710 @@ type Message struct {
 
 	// groups token – an encrypted string representing group membership
 	G string
+
+	// if the value is 1 the client should reconnect to the server, e.g.
+	// because the server is being shut down or restarted (reconnect command)
+	T int
+
+	// if the value is 1 the connection was aborted by the server and the
+	// client should disconnect (disconnect command)
+	D int
+}
+
+const (
+	serverReconnect  = 1
+	serverDisconnect = 1
+)
+
+// MessageMeta is a Message along with metadata recorded by the client when it
+// was received.
+type MessageMeta struct {
+	Message
+
+	// ReceivedAt is the local time at which the message was read from the
+	// connection.
+	ReceivedAt time.Time
+
+	// Seq is a sequence number assigned locally to each delivered message.
+	// It increases by one per message, across reconnects.
+	Seq uint64
+}
+
+// ReconnectEvent describes an upcoming reconnect attempt.
+type ReconnectEvent struct {
+	// Attempt counts the attempts since the connection was lost, starting
+	// at 1.
+	Attempt int
+
+	// Delay is the time the client waits before making the attempt.
+	Delay time.Duration
+
+	// Reason is the error that ended the previous connection or attempt.
+	Reason error
+}
+
+// State is the state of a client's connection to the server.
+type State int
+
+const (
+	// Connecting means the client is making its first connection.
+	Connecting State = iota
+
+	// Connected means the client has an open connection.
+	Connected
+
+	// Reconnecting means the connection was lost and the client is
+	// establishing a new one.
+	Reconnecting
+
+	// Disconnected means the client is stopped or closed, or gave up
+	// reconnecting.
+	Disconnected
+)
+
+func (s State) String() string {
+	switch s {
+	case Connecting:
+		return "connecting"
+	case Connected:
+		return "connected"
+	case Reconnecting:
+		return "reconnecting"
+	case Disconnected:
+		return "disconnected"
+	}
+	return "unknown"
 }
 
+// defaultNonRetryableCloseCodes are the close codes after which the client
+// does not reconnect if NonRetryableCloseCodes is nil.
+var defaultNonRetryableCloseCodes = []int{websocket.ClosePolicyViolation}
+
+// DeliveryPolicy determines what the client does with a received message when
+// nobody is ready to receive it from the messages channel.
+type DeliveryPolicy int
+
+const (
+	// DeliverBlock makes the read loop wait until the message is received or
+	// the client is closed.
+	DeliverBlock DeliveryPolicy = iota
+
+	// DeliverDrop discards the message and counts it in Dropped.
+	DeliverDrop
+)
+
+// Option configures a Client before it starts connecting.
+type Option func(*Client)
+
 // Client represents a SignlR client. It manages connections so you don't have
 // to!
 type Client struct {
+	// PingInterval, if set, makes the client request the /ping endpoint at
+	// this interval to keep the ASP.NET session alive.
+	PingInterval time.Duration
+
+	// Codec is used to (un)marshal the messages exchanged over the websocket
+	// connection. It defaults to JSONCodec.
+	Codec Codec
+
+	// Proxy specifies a function to return a proxy for the handshake
+	// requests and the websocket connection. It defaults to
+	// http.ProxyFromEnvironment.
+	Proxy func(*http.Request) (*url.URL, error)
+
+	// ResumeFrom is the id (the "C" field) of the last message processed by
+	// a previous client. When set, the server replays the messages after it.
+	// This only works while the messages are still in the server's message
+	// buffer.
+	ResumeFrom string
+
+	// DeliveryPolicy determines what happens to messages nobody is ready to
+	// receive. It defaults to DeliverBlock.
+	DeliveryPolicy DeliveryPolicy
+
+	// MessageBuffer is the capacity of the messages channels. Messages are
+	// only subject to the DeliveryPolicy once the buffer is full.
+	MessageBuffer int
+
+	// DeliverMeta makes the client deliver messages on the channel returned
+	// by MessagesWithMeta, along with their arrival time and sequence
+	// number, instead of on the one returned by Messages. It must be set
+	// when creating the client, so that no consumer of either channel is
+	// left without messages at runtime.
+	DeliverMeta bool
+
+	// ConnectTimeout, if set, bounds the whole handshake: negotiate, connect,
+	// start and waiting for the init message.
+	ConnectTimeout time.Duration
+
+	// InitTimeout bounds waiting for the init message after start. It
+	// defaults to 30 seconds; the handshake's own deadline, derived from
+	// ConnectTimeout or the server's TransportConnectTimeout, applies too.
+	InitTimeout time.Duration
+
+	// TokenProvider, if set, is called before each (re)connect to fetch a
+	// bearer token, which is sent with the handshake requests and the
+	// websocket dial. This way an expired token is replaced on reconnect.
+	// Clients sharing an authenticated session may share a TokenProvider;
+	// it is then called concurrently and must be safe for that.
+	TokenProvider func(ctx context.Context) (string, error)
+
+	// TokenInQuery sends the bearer token as the access_token query
+	// parameter instead of in the Authorization header. Browsers can't set
+	// headers on websocket requests, so some servers expect it there.
+	TokenInQuery bool
+
+	// OnUnauthorized, if set, is called when a handshake request is rejected
+	// with HTTP 401 or 403, to refresh the credentials. The request is then
+	// retried once; if it still fails, a *HandshakeError is returned.
+	OnUnauthorized func(ctx context.Context) error
+
+	// OnReconnect, if set, is called before each reconnect attempt.
+	OnReconnect func(ReconnectEvent)
+
+	// MaxReconnectDelay, if set, makes the delay between reconnect attempts
+	// double with each attempt, starting at 10 seconds, and caps it: it is
+	// never longer than MaxReconnectDelay, even below 10 seconds. Unset, the
+	// delay is always 10 seconds.
+	MaxReconnectDelay time.Duration
+
+	// MaxReconnectDuration, if set, is how long the client keeps trying to
+	// reconnect after the connection was lost, or the first attempt failed.
+	// It then gives up: the client is closed, its messages channels are
+	// closed, and LastError returns an error wrapping ErrReconnectTimeout,
+	// which is reported on Errors too.
+	MaxReconnectDuration time.Duration
+
+	// DisableAutoReconnect makes the application responsible for
+	// reconnecting, e.g. based on the errors it receives on Errors:
+	//
+	//   - By default, ConnectLoop reconnects on its own whenever the
+	//     connection is lost or an attempt fails, and Reconnect fails with
+	//     ErrAutoReconnect.
+	//   - With DisableAutoReconnect, ConnectLoop makes the first attempt
+	//     only, and after a lost connection or failed attempt waits for the
+	//     application to call Reconnect, which makes one attempt and returns
+	//     its error. MaxReconnectDelay and MaxReconnectDuration don't apply.
+	//
+	// In both modes, connections the server rejects with one of
+	// NonRetryableCloseCodes are not reestablished, and Stop and Restart
+	// work as usual.
+	DisableAutoReconnect bool
+
+	// Logger, if set, receives a "connected" event at info level for each
+	// established connection and a "disconnected" event when it ends.
+	Logger *slog.Logger
+
+	// MessageInterceptor, if set, is called with each received message
+	// before it is dispatched to handlers and delivered on the messages
+	// channel. It returns the message to use instead, and false to drop it.
+	// Keep-alives and hub method results never reach it, and the server's
+	// reconnect and disconnect commands are obeyed before it is called.
+	MessageInterceptor func(Message) (Message, bool)
+
+	// InvokeTimeout, if set, is the default timeout of Invoke calls whose
+	// context has no deadline. See SetMethodTimeout.
+	InvokeTimeout time.Duration
+
+	// WriteTimeout, if set, bounds each write to the connection. A write
+	// that doesn't complete in time fails with ErrWriteTimeout, and since
+	// that usually means the connection is dead, the connection is closed
+	// so that ConnectLoop establishes a new one. By default, writes have no
+	// deadline.
+	WriteTimeout time.Duration
+
+	// RecordTo, if set, receives every raw frame read from the server,
+	// newline-delimited, for replaying with NewReplay.
+	RecordTo io.Writer
+
+	// RateLimit, if set, limits outbound messages to this many per second,
+	// allowing bursts of up to RateBurst messages. Writes wait for the limit
+	// unless RateLimitFailFast is set, in which case they fail with
+	// ErrRateLimited.
+	RateLimit         float64
+	RateBurst         int
+	RateLimitFailFast bool
+
+	// ReadBufferSize and WriteBufferSize set the websocket I/O buffer sizes
+	// in bytes; zero uses the websocket package's defaults of 4096. Larger
+	// buffers help throughput for large messages. WriteBufferPool, if set,
+	// shares write buffers to reduce allocations.
+	ReadBufferSize  int
+	WriteBufferSize int
+	WriteBufferPool websocket.BufferPool
+
+	// MaxMessageSize, if set, is the largest message in bytes the client
+	// reads from the server, after reassembling fragmented frames. A larger
+	// message makes the websocket library close the connection, and the
+	// client reports an error wrapping websocket.ErrReadLimit on Errors.
+	// Since the server would send the message again to a client resuming
+	// after the last message it received, the client doesn't reconnect but
+	// gives up, like after one of the NonRetryableCloseCodes, and LastError
+	// returns the error.
+	MaxMessageSize int64
+
+	// EnableCompression offers the server per-message compression
+	// (permessage-deflate). If the server accepts, frames of at least
+	// CompressionThreshold bytes, 1 KB by default, are compressed; smaller
+	// ones cost more CPU to compress than they save in bandwidth, and may
+	// even grow. Set CompressionThreshold to a negative value to compress
+	// all frames.
+	EnableCompression    bool
+	CompressionThreshold int
+
+	// AdoptServerProtocol makes the client upgrade to the protocol version
+	// reported by the server when negotiating, if it is higher than the
+	// requested one, for the rest of the handshake. Either way, a server
+	// version with a different major version than the requested one fails
+	// the handshake.
+	AdoptServerProtocol bool
+
+	// Jitter randomly varies the ping interval and reconnect delays by up to
+	// this fraction in either direction, e.g. 0.2 for ±20%, so that many
+	// clients don't reconnect to a server in lockstep. JitterSource, if set,
+	// is the random source used, e.g. a seeded one for deterministic tests.
+	Jitter       float64
+	JitterSource rand.Source
+
+	// StopOnDecodeError makes the read loop end the connection when a frame
+	// can't be decoded, instead of reporting the error and skipping it.
+	StopOnDecodeError bool
+
+	// Subprotocols lists the websocket subprotocols offered to the server,
+	// for gateways that require one during the websocket handshake. If set,
+	// the server must select one of them; a connection on which it selected
+	// none, or one that wasn't offered, is closed and the connect fails.
+	Subprotocols []string
+
+	// Origin is the Origin header sent with the websocket handshake, for
+	// servers that check it. It defaults to "https://" followed by the host,
+	// or by HostHeader if set.
+	Origin string
+
+	// MaxOutboundSize, if set, is the largest frame in bytes the client will
+	// send. Larger messages fail with ErrMessageTooLarge instead of being
+	// dropped by the server; they are not split up, so callers need to chunk
+	// large arguments across invocations themselves.
+	MaxOutboundSize int
+
+	// PinnedCertFingerprint, if set, is the SHA-256 hash of the DER encoding
+	// of the server's certificate. Connections to servers presenting another
+	// certificate are rejected.
+	PinnedCertFingerprint []byte
+
+	// HostHeader, if set, is sent as the Host header of the handshake
+	// requests and the websocket handshake to the client's host, instead of
+	// the host itself, e.g. to connect to a server by IP address through a
+	// load balancer that routes by virtual host. It doesn't apply to the
+	// endpoint of a negotiate redirect.
+	HostHeader string
+
+	// ServerName, if set, is the server name sent for SNI and checked
+	// against the server's certificate, instead of the host the client
+	// connects to. Since it applies to every TLS connection, it is meant for
+	// connecting to a server directly, not through negotiate redirects.
+	ServerName string
+
+	// KeepAliveMultiplier scales the server's KeepAliveTimeout. If nothing is
+	// received within the scaled timeout, the connection is considered dead,
+	// even if the socket has not reported an error, and is closed so the
+	// client reconnects. It defaults to 1; a negative value disables the
+	// check.
+	KeepAliveMultiplier float64
+
+	// PathBuilder, if set, assembles the path and query of the connect,
+	// start and abort requests, for gateways that expect another URL shape.
+	// base is the endpoint path, e.g. "/signalr/connect", and params the
+	// query parameters the client would send. The result must include a
+	// query, since further parameters may be appended to it.
+	PathBuilder func(base string, params url.Values) string
+
+	// NoNegotiateRedirects makes the client not follow redirects of the
+	// negotiate request, which typically lead to a login page, e.g. for
+	// single sign-on. Negotiate then fails with a *HandshakeError holding
+	// the redirect's Location, so the caller can authenticate and store the
+	// session cookie in the jar of HTTPClient, which the next attempt sends.
+	// Unlike 401 and 403 responses, redirects don't trigger OnUnauthorized.
+	NoNegotiateRedirects bool
+
+	// DisableHTTP2 makes the handshake requests use HTTP/1.1 even if the
+	// server supports HTTP/2, which they use by default. The websocket
+	// connection always uses HTTP/1.1, which the upgrade requires. It has
+	// no effect with HTTPClient.
+	DisableHTTP2 bool
+
+	// HTTPClient, if set, is used for the handshake requests instead of a
+	// dedicated one, and its cookie jar for the websocket dial too. Several
+	// clients may share one HTTPClient, e.g. to share a cookie authenticated
+	// session; it is never modified. Proxy and PinnedCertFingerprint then
+	// only apply to the websocket dial.
+	HTTPClient *http.Client
+
+	// NonRetryableCloseCodes are the websocket close codes with which the
+	// server rejects the client for good. When the connection is closed with
+	// one of them, the client does not reconnect: it is closed, its messages
+	// channels are closed, and LastError returns the *websocket.CloseError.
+	// It defaults to 1008 (policy violation); set it to an empty slice to
+	// always reconnect.
+	NonRetryableCloseCodes []int
+
+	// MaxPendingWrites, if set, limits the number of writes in progress,
+	// including those waiting for the rate limiter or for another write to
+	// finish. Writes beyond the limit fail with ErrWriteQueueFull instead of
+	// waiting.
+	MaxPendingWrites int
+
+	// IsKeepAlive, if set, reports whether a received frame is a keep-alive,
+	// for servers or middleboxes that send something other than "{}".
+	// Keep-alives count as received for KeepAliveMultiplier but are not
+	// delivered.
+	IsKeepAlive func(raw []byte) bool
+
+	// IdleTimeout, if set, makes the client stop, as if Stop were called,
+	// once no message other than a keep-alive was received or sent for this
+	// long. Unlike a keep-alive timeout, which means the connection is dead
+	// and makes the client reconnect, this is an intentional disconnect of a
+	// working but unused connection: the client stays disconnected until
+	// Restart is called.
+	IdleTimeout time.Duration
+
+	// DialRetries is the number of times a websocket dial that fails with a
+	// network error is retried. The first retry waits DialRetryDelay, which
+	// defaults to 1 second, and each further one twice as long as the one
+	// before. This is separate from retrying the negotiate request.
+	DialRetries    int
+	DialRetryDelay time.Duration
+
+	// AlwaysNegotiate makes the client negotiate a new connection whenever
+	// the connection is lost. By default, it first tries to resume the lost
+	// connection through the reconnect endpoint while the server still knows
+	// it, i.e. within the server's DisconnectTimeout, which is faster and
+	// keeps the connection id; some servers and proxies don't support that.
+	AlwaysNegotiate bool
+
+	// ReliableRetries is the number of times InvokeReliable resends a call
+	// after the connection was lost. It defaults to 3.
+	ReliableRetries int
+
+	// GroupsTokenParam is the name of the query parameter carrying the
+	// groups token when reconnecting. It defaults to "groupsToken", which
+	// SignalR 1.0 and later expect; pre-1.0 servers expect "groups".
+	GroupsTokenParam string
+
+	// ReplayParams maps top-level fields of the negotiate response and of
+	// the messages the server sends to query parameters. The client
+	// captures the latest value of each of these fields and sends it back
+	// under the parameter's name on every subsequent connect and reconnect,
+	// for servers that route or authorize connections by a value they
+	// issued earlier, e.g. {"RoutingId": "routingId"}. Field names are
+	// matched exactly; string values are sent unquoted, others as JSON.
+	//
+	// Azure SignalR Service needs no mapping: the parameters it routes by,
+	// such as asrs.op and asrs_request_id, come with the negotiate
+	// redirect's URL, whose query the client keeps for the connection.
+	ReplayParams map[string]string
+
+	// MaxConcurrentInvokes, if set, limits the number of hub method calls
+	// waiting for their results, for servers that limit them per connection.
+	// Further calls wait until one of them completes, fails or is canceled,
+	// or until their context is done.
+	MaxConcurrentInvokes int
+
+	// OnRawResponse, if set, is called with the body of each negotiate and
+	// start response, and of rejected websocket handshakes (step "connect"),
+	// e.g. to capture them for troubleshooting. body is a copy the callback
+	// may keep.
+	OnRawResponse func(step string, statusCode int, body []byte)
+
+	// LenientHandshake accepts any successful start response instead of
+	// requiring the standard {"Response":"started"}, for proxies that
+	// rewrite it. The connection is still only considered established once
+	// the server's init message arrives, which it may send before or after
+	// the start response, within InitTimeout; frames received ahead of it
+	// are skipped.
+	LenientHandshake bool
+
+	// OnRawSend, if set, is called with each frame just before it is
+	// written to the connection, e.g. to capture the wire format of sent
+	// messages. It is called with the write mutex held and must not modify
+	// data. Frames sent with WritePrepared are not passed to it.
+	OnRawSend func(data []byte)
+
+	// OnMessageReceivedSize and OnMessageSentSize, if set, are called with
+	// the size in bytes of each frame read from and written to the
+	// connection, including keep-alives, e.g. to record size distributions.
+	// The received size is that of the raw frame, before it is decoded; the
+	// sent size is that of the encoded message, before compression. Like
+	// OnRawSend, OnMessageSentSize is called with the write mutex held and
+	// not for frames sent with WritePrepared.
+	OnMessageReceivedSize func(n int)
+	OnMessageSentSize     func(n int)
+
+	// DisallowUnknownFields makes the client report messages from the server
+	// that have fields it doesn't know about on Errors, to catch protocol
+	// drift early. Such messages are still processed.
+	DisallowUnknownFields bool
+
+	// NegotiateMethod is the HTTP method of the negotiate request, for
+	// servers and proxies that require POST. It defaults to GET.
+	NegotiateMethod string
+
+	// NegotiateBody, if set, is sent as the body of the negotiate request,
+	// with NegotiateContentType as its content type, which defaults to
+	// "application/json".
+	NegotiateBody        []byte
+	NegotiateContentType string
+
 	host     string
 	protocol string
 
+	httpClient *http.Client
+	clock      clock
+	limiter    *rateLimiter
+
+	rndMu sync.Mutex
+	rnd   *rand.Rand
+
+	// mu guards conn and nr, which are replaced on every (re)connect, the
+	// message id and groups token used to resume the message stream, and the
+	// current bearer token, as well as the connection data, which
+	// UpdateConnectionData may replace.
+	mu             sync.Mutex
+	conn           *websocket.Conn
+	nr             NegotiateResponse
+	messageID      string
+	groupsToken    string
+	token          string
 	connectionData string
 
-	conn *websocket.Conn
+	// replayed holds the values captured for ReplayParams, keyed by
+	// parameter name.
+	replayed map[string]string
+
+	// serviceToken is the access token issued by a negotiate redirect. It
+	// takes precedence over token for the redirected endpoint.
+	serviceToken string
+
+	// stopped is set by Stop, which signals wake so that ConnectLoop stops
+	// waiting to reconnect. restarts passes the requests of Restart to
+	// ConnectLoop, which makes the new connection itself so that it can't
+	// race with reconnecting.
+	stopped  bool
+	wake     chan struct{}
+	restarts chan reconnectRequest
+
+	// reconnects passes the requests of Reconnect to ConnectLoop.
+	reconnects chan reconnectRequest
 
+	// transport is the transport of the current connection.
+	transport string
+
+	// connGen is incremented for every new connection. It is only changed
+	// with mu held.
+	connGen atomic.Uint64
+
+	// up is closed while the client has a connection, which was
+	// established at connectedSince.
+	up             chan struct{}
+	connectedSince time.Time
+
+	// lastErr is the error that ended the last connection.
+	lastErr error
+
+	// writeMu serializes writes to conn, which supports only one concurrent
+	// writer. pendingWrites counts the writes waiting for it or in progress.
+	writeMu       sync.Mutex
+	pendingWrites atomic.Int64
+
+	// messages belongs to the client rather than to a connection: it is
+	// created once and never replaced, so that the read loop of every new
+	// connection feeds the channel callers already hold.
 	messages chan Message
+
+	// messagesMeta is used instead of messages if DeliverMeta is set. seq
+	// is only accessed by the read loop.
+	messagesMeta chan MessageMeta
+	seq          uint64
+	dropped      atomic.Uint64
+
+	// subsMu guards subs, the channels returned by MessagesCtx.
+	subsMu sync.Mutex
+	subs   map[*subscriber]struct{}
+
+	// lastReceived is the time, in Unix nanoseconds, at which the last frame
+	// was received, or the current connection was established.
+	lastReceived atomic.Int64
+
+	// lastActivity is the time, in Unix nanoseconds, at which the last
+	// message other than a keep-alive was received or sent, or the current
+	// connection was established.
+	lastActivity atomic.Int64
+
+	// Statistics reported by Stats.
+	connects      atomic.Int64
+	received      atomic.Int64
+	sent          atomic.Int64
+	lastKeepAlive atomic.Int64
+
+	// handlersMu guards handlers and groups, which belong to the client
+	// rather than to a connection and so survive reconnects.
+	handlersMu sync.RWMutex
+	handlers   map[string]*handlerSet
+	groups     []hubs.ClientMsg
+
+	// invokeMu guards invocationID and pending, which match hub method
+	// results to the Invoke calls waiting for them, streams, which receive
+	// the progress updates of InvokeStream calls, and the per-method Invoke
+	// timeouts.
+	invokeMu       sync.Mutex
+	invocationID   int64
+	pending        map[int64]*invocation
+	streams        map[int64]*stream
+	methodTimeouts map[string]time.Duration
+
+	// invokeSem holds a token for each pending invocation if
+	// MaxConcurrentInvokes is set.
+	invokeSem chan struct{}
+
+	// stateMu guards state, the hub state round-tripped with the server.
+	stateMu sync.Mutex
+	state   map[string]json.RawMessage
+
+	// pongMu guards pingSeq and pongs, which match pongs to the health
+	// checks waiting for them.
+	pongMu  sync.Mutex
+	pingSeq uint64
+	pongs   map[string]chan struct{}
+
+	errs chan error
+
+	// done is closed by Close to stop all background work. wg tracks the
+	// goroutines doing that work; goMu makes sure none is added once done is
+	// closed.
+	done      chan struct{}
+	closeOnce sync.Once
+	goMu      sync.Mutex
+	wg        sync.WaitGroup
+
+	// ctx is canceled when done is closed, so that the requests the
+	// background goroutines make don't hold up Close.
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 func (c *Client) setConnectionData(cd string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.connectionData = url.QueryEscape(cd)
 }
 
-func (c *Client) negotiate() (nr negotiateResponse, err error) {
-	uri := "https://" + c.host +
-		"/signalr/negotiate?clientProtocol=" + c.protocol +
-		"&connectionData=" + c.connectionData
+// escapedConnectionData returns the connection data, escaped for use in a
+// query string.
+func (c *Client) escapedConnectionData() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.connectionData
+}
+
+// UpdateConnectionData replaces the connection data, i.e. the hubs the client
+// subscribes to, and reconnects. Since the server binds the hubs to the
+// connection when negotiating, this is not an in-place change but a new
+// connection, made like Restart makes it. Handlers stay registered, including
+// those of hubs no longer subscribed to.
+func (c *Client) UpdateConnectionData(ctx context.Context, connectionData string) (err error) {
+	// Stop first, so that the abort names the hubs of the old connection.
+	if !c.isStopped() {
+		err = c.Stop()
+		if err != nil {
+			trace.Error(err)
+		}
+	}
+	c.setConnectionData(connectionData)
+
+	err = c.Restart(ctx)
+	if err != nil {
+		trace.Error(err)
+		return
+	}
+	return
+}
 
-	scraper, err := scraper.NewTransport(http.DefaultTransport)
+// Negotiate performs only the negotiate step of the handshake and returns the
+// server's response, without connecting. It is meant for diagnosing
+// connectivity and authentication problems, and for driving the handshake
+// step by step with Connect and Start.
+func (c *Client) Negotiate(ctx context.Context) (nr NegotiateResponse, err error) {
+	err = c.refreshToken(ctx)
 	if err != nil {
-		log.Fatal(err)
+		trace.Error(err)
+		return
 	}
 
-	//client := http.Client{Transport: scraper}
-	http.DefaultTransport = scraper
+	return c.negotiate(ctx)
+}
+
+// maxNegotiateRedirects is the number of negotiate redirects followed before
+// giving up.
+const maxNegotiateRedirects = 10
+
+func (c *Client) negotiate(ctx context.Context) (nr NegotiateResponse, err error) {
+	host := c.host
+	base := "/signalr"
+	query := ""
+
+	c.mu.Lock()
+	c.serviceToken = ""
+	c.mu.Unlock()
+
+	for redirects := 0; ; redirects++ {
+		uri := "https://" + host + base +
+			"/negotiate?clientProtocol=" + c.protocol +
+			"&connectionData=" + c.escapedConnectionData() + query
+
+		nr, err = c.negotiateAt(ctx, uri)
+		if err != nil {
+			trace.Error(err)
+			return
+		}
+
+		if nr.RedirectURL == "" {
+			nr.host = host
+			nr.query = query
+			return
+		}
+
+		if redirects == maxNegotiateRedirects {
+			err = errors.New("too many negotiate redirects")
+			return
+		}
+
+		var u *url.URL
+		u, err = url.Parse(nr.RedirectURL)
+		if err != nil {
+			trace.Error(err)
+			return
+		}
+
+		host = u.Host
+		base = strings.TrimSuffix(u.Path, "/")
+		query = ""
+		if u.RawQuery != "" {
+			query = "&" + u.RawQuery
+		}
+
+		if nr.AccessToken != "" {
+			c.mu.Lock()
+			c.serviceToken = nr.AccessToken
+			c.mu.Unlock()
+		}
+	}
+}
 
+// negotiateAt requests the negotiate endpoint at uri.
+func (c *Client) negotiateAt(ctx context.Context, uri string) (nr NegotiateResponse, err error) {
 	for i := 0; i < 5; i++ {
 		var resp *http.Response
-		resp, err = http.Get(uri)
+		resp, err = c.doHandshake(ctx, "negotiate", c.negotiateMethod(), uri, c.NegotiateBody)
 		if err != nil {
 			trace.Error(err)
 			return
@@ -102,7 +894,30 @@ func (c *Client) negotiate() (nr negotiateResponse, err error) {
 
 		if resp.Status != "200 OK" {
 			trace.DebugMessage("non-200 response while negotiating: " + resp.Status)
-			time.Sleep(time.Minute)
+			err = &HandshakeError{Step: "negotiate", StatusCode: resp.StatusCode}
+			c.discardResponse("negotiate", resp)
+			derr := resp.Body.Close()
+			if derr != nil {
+				trace.Error(derr)
+			}
+
+			// A redirect is typically an authentication challenge,
+			// which retrying won't get past.
+			if resp.StatusCode >= 300 && resp.StatusCode <= 399 {
+				err = &HandshakeError{
+					Step:       "negotiate",
+					StatusCode: resp.StatusCode,
+					Location:   resp.Header.Get("Location"),
+				}
+				return
+			}
+
+			select {
+			case <-ctx.Done():
+				err = ctx.Err()
+				return
+			case <-c.clock.After(time.Minute):
+			}
 			continue
 		}
 
@@ -119,12 +934,14 @@ func (c *Client) negotiate() (nr negotiateResponse, err error) {
 			trace.Error(err)
 			return
 		}
+		c.rawResponse("negotiate", resp.StatusCode, body)
 
 		err = json.Unmarshal(body, &nr)
 		if err != nil {
 			trace.Error(err)
 			return
 		}
+		c.captureParams(body)
 
 		return
 	}
@@ -132,185 +949,2378 @@ func (c *Client) negotiate() (nr negotiateResponse, err error) {
 	return
 }
 
-func (c *Client) connect(nr negotiateResponse) (conn *websocket.Conn, err error) {
-	path := nr.URL +
-		"/connect?transport=webSockets&clientProtocol=" + c.protocol +
-		"&connectionToken=" + nr.connectionTokenEscaped() +
-		"&connectionData=" + c.connectionData
-	url := "wss://" + c.host + path
-
-	conn, resp, err := websocket.DefaultDialer.Dial(url, http.Header{})
-	if err != nil {
-		trace.Error(err)
-
-		if err == websocket.ErrBadHandshake {
-			defer func() {
-				derr := resp.Body.Close()
-				if derr != nil {
-					trace.Error(derr)
-				}
-			}()
-
-			body, err2 := ioutil.ReadAll(resp.Body)
-			if err != nil {
-				trace.Error(err2)
-				err = err2
-				return
-			}
-
-			log.Println(string(body))
-			log.Println(resp)
-			log.Println(resp.Request)
-			return
-		}
+// rawResponse passes the body of a handshake response to OnRawResponse, if
+// set.
+func (c *Client) rawResponse(step string, statusCode int, body []byte) {
+	if c.OnRawResponse == nil {
+		return
 	}
-
-	return
+	c.OnRawResponse(step, statusCode, append([]byte(nil), body...))
 }
 
-func (c *Client) start(nr negotiateResponse, conn *websocket.Conn) (err error) {
-	fmt.Println("start conn")
-	path := nr.URL +
-		"/start?transport=webSockets&clientProtocol=" + c.protocol +
-		"&connectionToken=" + nr.connectionTokenEscaped() +
-		"&connectionData=" + c.connectionData
-	url := "https://" + c.host + path
-
-	resp, err := http.Get(url)
-	if err != nil {
-		trace.Error(err)
+// discardResponse reads the body of a handshake response that is not
+// otherwise used and passes it to OnRawResponse, if set.
+func (c *Client) discardResponse(step string, resp *http.Response) {
+	if c.OnRawResponse == nil {
 		return
 	}
 
-	defer func() {
-		derr := resp.Body.Close()
-		if derr != nil {
-			trace.Error(derr)
-		}
-	}()
-
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		trace.Error(err)
 		return
 	}
+	c.rawResponse(step, resp.StatusCode, body)
+}
 
-	var sr startResponse
-	err = json.Unmarshal(body, &sr)
-	if err != nil {
-		trace.Error(err)
-		return
+// newRequest creates a request for one of the handshake endpoints. Only the
+// negotiate request has a body.
+func (c *Client) newRequest(ctx context.Context, method, uri string, body []byte) (req *http.Request, err error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
 	}
 
-	// Confirm the server response is what we expect.
-	if sr.Response != "started" {
-		err = errors.New("start response is not 'started': " + sr.Response)
+	req, err = http.NewRequestWithContext(ctx, method, uri+c.tokenParam(), r)
+	if err != nil {
 		trace.Error(err)
 		return
 	}
 
-	fmt.Println("start read messages on new conn")
-	// Wait for the init message.
-	t, p, err := conn.ReadMessage()
-	if err != nil {
-		trace.Error(err)
-		return
+	for k, v := range c.handshakeHeader() {
+		req.Header[k] = v
+	}
+	req.Host = c.hostHeader(req.URL.Host)
+	if body != nil {
+		req.Header.Set("Content-Type", c.negotiateContentType())
 	}
+	return
+}
 
-	// Verify the correct response type was received.
-	if t != websocket.TextMessage {
-		err = errors.New("unexpected websocket control type:" + strconv.Itoa(t))
-		trace.Error(err)
-		return
+func (c *Client) negotiateMethod() string {
+	if c.NegotiateMethod != "" {
+		return c.NegotiateMethod
 	}
+	return http.MethodGet
+}
 
-	// Extract the server message.
-	var pcm Message
-	err = json.Unmarshal(p, &pcm)
-	if err != nil {
-		trace.Error(err)
-		return
+func (c *Client) negotiateContentType() string {
+	if c.NegotiateContentType != "" {
+		return c.NegotiateContentType
 	}
+	return "application/json"
+}
 
-	if pcm.S != serverInitialized {
-		err = errors.New("unexpected S value received from server: " + strconv.Itoa(pcm.S))
-		trace.Error(err)
-		return
+// handshakeHeader returns the headers sent with every handshake request and
+// the websocket dial.
+func (c *Client) handshakeHeader() http.Header {
+	h := http.Header{}
+	if token := c.currentToken(); token != "" && !c.TokenInQuery {
+		h.Set("Authorization", "Bearer "+token)
+	}
+	return h
+}
+
+// hostHeader returns the Host header of requests to host, which is HostHeader
+// for the client's host.
+func (c *Client) hostHeader(host string) string {
+	if c.HostHeader != "" && host == c.host {
+		return c.HostHeader
+	}
+	return host
+}
+
+// tokenParam returns the access_token query parameter if the bearer token is
+// sent in the query string.
+func (c *Client) tokenParam() string {
+	if token := c.currentToken(); token != "" && c.TokenInQuery {
+		return "&access_token=" + url.QueryEscape(token)
+	}
+	return ""
+}
+
+func (c *Client) currentToken() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.serviceToken != "" {
+		return c.serviceToken
+	}
+	return c.token
+}
+
+// refreshToken fetches a fresh bearer token from the TokenProvider, if any.
+func (c *Client) refreshToken(ctx context.Context) (err error) {
+	if c.TokenProvider == nil {
+		return
+	}
+
+	token, err := c.TokenProvider(ctx)
+	if err != nil {
+		trace.Error(err)
+		return
+	}
+
+	c.mu.Lock()
+	c.token = token
+	c.mu.Unlock()
+	return
+}
+
+// checkProtocol verifies that the protocol version supported by the server is
+// compatible with the one the client requested, i.e. that their major versions
+// match.
+func (c *Client) checkProtocol(nr NegotiateResponse) (err error) {
+	if nr.ProtocolVersion == "" || nr.ProtocolVersion == c.protocol {
+		return
+	}
+
+	if majorVersion(nr.ProtocolVersion) != majorVersion(c.protocol) {
+		err = errors.New("server protocol version " + nr.ProtocolVersion +
+			" is incompatible with requested version " + c.protocol)
+		return
+	}
+
+	trace.DebugMessage("[signalR.checkProtocol] Server protocol version " + nr.ProtocolVersion +
+		" differs from requested version " + c.protocol)
+	return
+}
+
+func majorVersion(v string) string {
+	major, _, _ := strings.Cut(v, ".")
+	return major
+}
+
+// connProtocol returns the protocol version to use for a connection after
+// negotiating.
+func (c *Client) connProtocol(nr NegotiateResponse) string {
+	if c.AdoptServerProtocol && nr.ProtocolVersion != "" &&
+		majorVersion(nr.ProtocolVersion) == majorVersion(c.protocol) &&
+		compareVersions(nr.ProtocolVersion, c.protocol) > 0 {
+		return nr.ProtocolVersion
+	}
+	return c.protocol
+}
+
+// compareVersions compares two dotted version numbers, e.g. "1.5" and "1.10",
+// returning -1, 0 or 1 like strings.Compare. Parts that aren't numbers count
+// as 0.
+func compareVersions(a, b string) int {
+	as := strings.Split(a, ".")
+	bs := strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	}
+	return 0
+}
+
+func (c *Client) proxy() func(*http.Request) (*url.URL, error) {
+	if c.Proxy == nil {
+		return http.ProxyFromEnvironment
+	}
+	return c.Proxy
+}
+
+// tlsConfig returns the TLS configuration for the handshake requests and the
+// websocket connection, or nil for the defaults.
+func (c *Client) tlsConfig() *tls.Config {
+	if c.PinnedCertFingerprint == nil && c.ServerName == "" {
+		return nil
+	}
+
+	cfg := &tls.Config{ServerName: c.ServerName}
+	if c.PinnedCertFingerprint != nil {
+		cfg.VerifyConnection = c.verifyPinnedCert
+	}
+	return cfg
+}
+
+// verifyPinnedCert rejects connections whose leaf certificate doesn't match
+// PinnedCertFingerprint. It runs in addition to the regular verification.
+func (c *Client) verifyPinnedCert(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("server presented no certificate")
+	}
+
+	sum := sha256.Sum256(cs.PeerCertificates[0].Raw)
+	if !bytes.Equal(sum[:], c.PinnedCertFingerprint) {
+		return errors.New("server certificate does not match the pinned fingerprint")
+	}
+	return nil
+}
+
+// newHTTPClient creates the HTTP client used for the handshake requests.
+func (c *Client) newHTTPClient() (client *http.Client, err error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = c.proxy()
+	transport.TLSClientConfig = c.tlsConfig()
+
+	// Negotiate HTTP/2 through ALPN unless disabled; a custom TLS config
+	// would otherwise turn it off.
+	transport.ForceAttemptHTTP2 = !c.DisableHTTP2
+	if c.DisableHTTP2 {
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+
+	scraper, err := scraper.NewTransport(transport)
+	if err != nil {
+		trace.Error(err)
+		return
+	}
+
+	client = &http.Client{Transport: scraper}
+	return
+}
+
+// dialer returns the websocket dialer used to connect to the server.
+func (c *Client) dialer() *websocket.Dialer {
+	d := *websocket.DefaultDialer
+	d.Proxy = c.proxy()
+	d.Subprotocols = c.Subprotocols
+	d.TLSClientConfig = c.tlsConfig()
+	d.ReadBufferSize = c.ReadBufferSize
+	d.WriteBufferSize = c.WriteBufferSize
+	d.WriteBufferPool = c.WriteBufferPool
+	d.Jar = c.httpClient.Jar
+	d.EnableCompression = c.EnableCompression
+	return &d
+}
+
+// Connect performs the connect step of the handshake: it opens the websocket
+// connection for the connection negotiated in nr. Together with Negotiate and
+// Start, it lets callers drive the handshake one step at a time, e.g. in tests
+// or unusual flows; New does all of them. It returns either a connection or an
+// error, never neither.
+func (c *Client) Connect(ctx context.Context, nr NegotiateResponse) (conn *websocket.Conn, err error) {
+	return c.dial(ctx, nr, "connect")
+}
+
+// dial opens a websocket connection to the connect or reconnect endpoint. It
+// retries dials that fail with a network error, such as a DNS failure or an
+// unreachable host, up to DialRetries times.
+func (c *Client) dial(ctx context.Context, nr NegotiateResponse, endpoint string) (conn *websocket.Conn, err error) {
+	delay := c.DialRetryDelay
+	if delay == 0 {
+		delay = time.Second
+	}
+
+	for attempt := 0; ; attempt++ {
+		conn, err = c.dialOnce(ctx, nr, endpoint)
+		if err == nil || attempt == c.DialRetries {
+			return
+		}
+
+		var ne net.Error
+		if !errors.As(err, &ne) {
+			return
+		}
+
+		trace.DebugMessage("[signalR.dial] Dial failed, retrying")
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		case <-c.clock.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+func (c *Client) dialOnce(ctx context.Context, nr NegotiateResponse, endpoint string) (conn *websocket.Conn, err error) {
+	path, err := c.endpointPath(nr, endpoint, c.resumeParams()+c.replayParams()+c.tokenParam())
+	if err != nil {
+		trace.Error(err)
+		return
+	}
+	host := c.hostFor(nr)
+	url := "wss://" + host + path
+
+	header := c.handshakeHeader()
+	header.Set("Origin", c.origin())
+	header.Set("Host", c.hostHeader(host))
+
+	conn, resp, err := c.dialer().DialContext(ctx, url, header)
+	if err != nil {
+		trace.Error(err)
+
+		if err == websocket.ErrBadHandshake && resp != nil {
+			defer func() {
+				derr := resp.Body.Close()
+				if derr != nil {
+					trace.Error(derr)
+				}
+			}()
+
+			// The body only helps diagnose the rejection, so failing
+			// to read it must not hide it.
+			body, err2 := ioutil.ReadAll(resp.Body)
+			if err2 != nil {
+				trace.Error(err2)
+			}
+
+			c.rawResponse(endpoint, resp.StatusCode, body)
+			log.Println(string(body))
+			log.Println(resp)
+			log.Println(resp.Request)
+
+			// The server rejected the upgrade, e.g. because of the
+			// Origin header.
+			err = &HandshakeError{Step: endpoint, StatusCode: resp.StatusCode}
+		}
+		conn = nil
+		return
+	}
+
+	err = c.checkSubprotocol(conn)
+	if err != nil {
+		trace.Error(err)
+		cerr := conn.Close()
+		if cerr != nil {
+			trace.Error(cerr)
+		}
+		conn = nil
+		return
+	}
+
+	return
+}
+
+// endpointPath returns the path and query of a request to the endpoint of the
+// connection negotiated in nr, e.g. "connect". extra holds additional query
+// parameters, each starting with "&". The result is passed through
+// PathBuilder, if set.
+func (c *Client) endpointPath(nr NegotiateResponse, endpoint, extra string) (path string, err error) {
+	base := nr.URL + "/" + endpoint
+	query := "transport=webSockets&clientProtocol=" + c.connProtocol(nr) +
+		"&connectionToken=" + nr.connectionTokenEscaped() +
+		"&connectionData=" + c.escapedConnectionData() + nr.query + extra
+
+	if c.PathBuilder == nil {
+		path = base + "?" + query
+		return
+	}
+
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		trace.Error(err)
+		return
+	}
+
+	path = c.PathBuilder(base, params)
+	return
+}
+
+// hostFor returns the host serving the connection negotiated in nr.
+func (c *Client) hostFor(nr NegotiateResponse) string {
+	if nr.host != "" {
+		return nr.host
+	}
+	return c.host
+}
+
+// origin returns the Origin header sent with the websocket handshake.
+func (c *Client) origin() string {
+	if c.Origin != "" {
+		return c.Origin
+	}
+	return "https://" + c.hostHeader(c.host)
+}
+
+// checkSubprotocol verifies that the server selected one of the subprotocols
+// the client offered, if it offered any. Otherwise, a gateway may have
+// upgraded the connection without honoring the subprotocol, which would only
+// show later as dropped frames.
+func (c *Client) checkSubprotocol(conn *websocket.Conn) (err error) {
+	selected := conn.Subprotocol()
+	if selected == "" {
+		if len(c.Subprotocols) > 0 {
+			err = fmt.Errorf("server selected none of the offered websocket subprotocols %q", c.Subprotocols)
+		}
+		return
+	}
+
+	for _, p := range c.Subprotocols {
+		if p == selected {
+			return
+		}
+	}
+
+	err = fmt.Errorf("server selected websocket subprotocol %q, which was not offered (offered %q)", selected, c.Subprotocols)
+	return
+}
+
+// Subprotocol returns the websocket subprotocol the server selected for the
+// current connection, or "" if there is none or the client isn't connected.
+func (c *Client) Subprotocol() string {
+	conn := c.currentConn()
+	if conn == nil {
+		return ""
+	}
+	return conn.Subprotocol()
+}
+
+// Start performs the start step of the handshake for conn, opened by Connect,
+// and waits for the server's init message. It then makes conn the client's
+// current connection. The caller is responsible for closing conn if Start
+// fails.
+func (c *Client) Start(ctx context.Context, nr NegotiateResponse, conn *websocket.Conn) (err error) {
+	fmt.Println("start conn")
+	path, err := c.endpointPath(nr, "start", "")
+	if err != nil {
+		trace.Error(err)
+		return
+	}
+	url := "https://" + c.hostFor(nr) + path
+
+	resp, err := c.doHandshake(ctx, "start", http.MethodGet, url, nil)
+	if err != nil {
+		trace.Error(err)
+		return
+	}
+
+	defer func() {
+		derr := resp.Body.Close()
+		if derr != nil {
+			trace.Error(derr)
+		}
+	}()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		trace.Error(err)
+		return
+	}
+	c.rawResponse("start", resp.StatusCode, body)
+
+	if c.LenientHandshake {
+		err = checkStartLenient(resp.StatusCode, body)
+	} else {
+		err = checkStart(body)
+	}
+	if err != nil {
+		trace.Error(err)
+		return
+	}
+
+	fmt.Println("start read messages on new conn")
+	err = c.waitInit(ctx, conn)
+	if err != nil {
+		trace.Error(err)
+		return
 	}
 
 	// Since we got to this point, the connection is successful. So we set
 	// the connection for the client.
 	fmt.Println("conn is SET - return")
+	err = c.activate(nr, conn)
+	return
+}
+
+// checkStart confirms the start response is what we expect.
+func checkStart(body []byte) (err error) {
+	var sr startResponse
+	err = json.Unmarshal(body, &sr)
+	if err != nil {
+		trace.Error(err)
+		return
+	}
+
+	if sr.Response != "started" {
+		err = errors.New("start response is not 'started': " + sr.Response)
+		return
+	}
+	return
+}
+
+// checkStartLenient accepts any successful start response, for proxies that
+// rewrite it. The init message is still required.
+func checkStartLenient(statusCode int, body []byte) (err error) {
+	if statusCode < 200 || statusCode > 299 {
+		err = &HandshakeError{Step: "start", StatusCode: statusCode}
+		return
+	}
+
+	if checkStart(body) != nil {
+		trace.DebugMessage("[signalR.Start] Ignoring unexpected start response: " + string(body))
+	}
+	return
+}
+
+// activate makes conn, established for the connection negotiated in nr, the
+// client's current connection.
+func (c *Client) activate(nr NegotiateResponse, conn *websocket.Conn) (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed() {
+		err = ErrClosed
+		return
+	}
+
+	if c.MaxMessageSize > 0 {
+		conn.SetReadLimit(c.MaxMessageSize)
+	}
+	conn.SetPongHandler(c.handlePong)
+	conn.SetCloseHandler(func(code int, text string) error {
+		return c.handleClose(conn, code, text)
+	})
 	c.conn = conn
+	c.connGen.Add(1)
+	c.nr = nr
+	c.transport = transportWebSockets
+	c.connectedSince = c.clock.Now()
+	select {
+	case <-c.up:
+	default:
+		close(c.up)
+	}
+	return
+}
+
+// Conn returns the current websocket connection, or nil if the client isn't
+// connected. It is meant for setting options the client doesn't expose.
+//
+// Writing to the connection directly bypasses the client's write mutex and can
+// corrupt frames sent concurrently by the client; reading from it competes with
+// the client's read loop.
+func (c *Client) Conn() *websocket.Conn {
+	return c.currentConn()
+}
+
+// waitInit waits for the init message on a new connection, skipping any
+// keep-alive messages the server sends first. It gives up at the context's
+// deadline or after InitTimeout, whichever comes first.
+func (c *Client) waitInit(ctx context.Context, conn *websocket.Conn) (err error) {
+	timeout := c.InitTimeout
+	if timeout == 0 {
+		timeout = defaultInitTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	err = conn.SetReadDeadline(deadline)
+	if err != nil {
+		trace.Error(err)
+		return
+	}
+
+	for {
+		var t int
+		var p []byte
+		t, p, err = conn.ReadMessage()
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				err = errors.New("timed out waiting for init message")
+			}
+			trace.Error(err)
+			return
+		}
+
+		// Verify the correct response type was received.
+		if t != websocket.TextMessage {
+			err = errors.New("unexpected websocket control type:" + strconv.Itoa(t))
+			trace.Error(err)
+			return
+		}
+
+		// Keep-alive messages may arrive before the init message.
+		if c.isKeepAlive(p) {
+			continue
+		}
+
+		// Extract the server message.
+		var pcm Message
+		err = c.codec().Unmarshal(p, &pcm)
+		if c.LenientHandshake && (err != nil || pcm.S != serverInitialized) {
+			// Skip whatever a proxy sent ahead of the init message.
+			trace.DebugMessage("[signalR.waitInit] Skipping frame before init message: " + string(p))
+			err = nil
+			continue
+		}
+		if err != nil {
+			trace.Error(err)
+			return
+		}
+
+		if pcm.S != serverInitialized {
+			err = errors.New("unexpected S value received from server: " + strconv.Itoa(pcm.S))
+			trace.Error(err)
+			return
+		}
+
+		break
+	}
+
+	err = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		trace.Error(err)
+		return
+	}
+	return
+}
+
+// ActiveTransport returns the name of the transport of the current connection,
+// e.g. "webSockets", or "" if the client isn't connected.
+func (c *Client) ActiveTransport() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.transport
+}
+
+func (c *Client) currentConn() *websocket.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn
+}
+
+// currentConnGen returns the current connection along with its generation.
+func (c *Client) currentConnGen() (*websocket.Conn, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn, c.connGen.Load()
+}
+
+// MessageID returns the id of the last message received from the server. It
+// can be persisted and passed as ResumeFrom to a new client to continue the
+// message stream where this one left off.
+func (c *Client) MessageID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.messageID
+}
+
+// resumeParams returns the query parameters that make the server resume the
+// message stream after the last received message.
+func (c *Client) resumeParams() (params string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.messageID != "" {
+		params += "&messageId=" + url.QueryEscape(c.messageID)
+	}
+	if c.groupsToken != "" {
+		name := c.GroupsTokenParam
+		if name == "" {
+			name = "groupsToken"
+		}
+		params += "&" + url.QueryEscape(name) + "=" + url.QueryEscape(c.groupsToken)
+	}
+	return
+}
+
+// captureParams records the values of the fields in p that ReplayParams maps
+// to query parameters.
+func (c *Client) captureParams(p []byte) {
+	if len(c.ReplayParams) == 0 {
+		return
+	}
+
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(p, &fields)
+	if err != nil {
+		trace.Error(err)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for field, param := range c.ReplayParams {
+		raw, ok := fields[field]
+		if !ok {
+			continue
+		}
+
+		var value string
+		if json.Unmarshal(raw, &value) != nil {
+			value = string(raw)
+		}
+
+		if c.replayed == nil {
+			c.replayed = make(map[string]string)
+		}
+		c.replayed[param] = value
+	}
+}
+
+// replayParams returns the query parameters carrying the values captured for
+// ReplayParams, sorted by name.
+func (c *Client) replayParams() (params string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	names := make([]string, 0, len(c.replayed))
+	for name := range c.replayed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		params += "&" + url.QueryEscape(name) + "=" + url.QueryEscape(c.replayed[name])
+	}
+	return
+}
+
+func (c *Client) trackMessage(msg Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if msg.C != "" {
+		c.messageID = msg.C
+	}
+	if msg.G != "" {
+		c.groupsToken = msg.G
+	}
+}
+
+// TransportConnectTimeout returns the time the server allows for establishing
+// the transport after negotiating, as advertised by the server when the
+// current connection was negotiated.
+func (c *Client) TransportConnectTimeout() time.Duration {
+	nr := c.negotiated()
+	return seconds(nr.TransportConnectTimeout)
+}
+
+func (c *Client) negotiated() NegotiateResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.nr
+}
+
+// ConnectionToken returns the connection token of the current or last
+// connection, as issued by the server, e.g. for crafting requests with
+// external tools or correlating server logs. It is empty before the first
+// negotiate.
+func (c *Client) ConnectionToken() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.nr.ConnectionToken
+}
+
+// ConnectionTokenEscaped returns the connection token like ConnectionToken,
+// escaped for use in a query string.
+func (c *Client) ConnectionTokenEscaped() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.nr.connectionTokenEscaped()
+}
+
+// Preflight makes a HEAD request to the host before connecting. It resolves
+// the host and sets up a TLS connection, which the handshake then reuses, and
+// surfaces connectivity and certificate problems early. Any response from the
+// server counts as success.
+func (c *Client) Preflight(ctx context.Context) (err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, "https://"+c.host+"/", nil)
+	if err != nil {
+		trace.Error(err)
+		return
+	}
+	req.Host = c.hostHeader(c.host)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		trace.Error(err)
+		err = fmt.Errorf("preflight to %s failed: %w", c.host, err)
+		return
+	}
+
+	err = resp.Body.Close()
+	if err != nil {
+		trace.Error(err)
+		return
+	}
+	return
+}
+
+// Ping requests the /ping endpoint, which keeps the ASP.NET session alive for
+// cookie-authenticated connections and confirms the server is reachable. This
+// is unrelated to websocket-level ping frames.
+func (c *Client) Ping(ctx context.Context) (err error) {
+	nr := c.negotiated()
+	uri := "https://" + c.hostFor(nr) +
+		"/signalr/ping?clientProtocol=" + c.connProtocol(nr) +
+		"&connectionToken=" + nr.connectionTokenEscaped() +
+		"&connectionData=" + c.escapedConnectionData() + nr.query
+
+	req, err := c.newRequest(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		trace.Error(err)
+		return
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		trace.Error(err)
+		return
+	}
+
+	defer func() {
+		derr := resp.Body.Close()
+		if derr != nil {
+			trace.Error(derr)
+		}
+	}()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		trace.Error(err)
+		return
+	}
+
+	var pr pingResponse
+	err = json.Unmarshal(body, &pr)
+	if err != nil {
+		trace.Error(err)
+		return
+	}
+
+	if pr.Response != "pong" {
+		err = errors.New("ping response is not 'pong': " + pr.Response)
+		trace.Error(err)
+		return
+	}
+
+	return
+}
+
+func (c *Client) pingLoop() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-c.clock.After(c.jitter(c.PingInterval)):
+		}
+
+		ctx, cancel := c.withTimeout(c.ctx, c.PingInterval)
+		err := c.Ping(ctx)
+		cancel()
+		if err != nil {
+			trace.Error(err)
+		}
+	}
+}
+
+// establish makes a new connection after the previous one was lost at lostAt,
+// or the first one if lostAt is zero. Within the server's DisconnectTimeout,
+// the server still knows the connection, so the client reuses it through the
+// reconnect endpoint, which saves the negotiate and start requests and keeps
+// the connection id. Otherwise, or if that fails, it makes a new connection.
+func (c *Client) establish(ctx context.Context, lostAt time.Time) (err error) {
+	nr := c.negotiated()
+	if !lostAt.IsZero() && !c.AlwaysNegotiate && nr.ConnectionToken != "" &&
+		c.clock.Now().Sub(lostAt) < seconds(nr.DisconnectTimeout) {
+		err = c.reconnect(ctx, nr)
+		if err == nil {
+			return
+		}
+		trace.Error(err)
+		trace.DebugMessage("[signalR.establish] Reconnect failed, negotiating a new connection")
+	}
+
+	return c.init(ctx)
+}
+
+// reconnect re-establishes the connection negotiated in nr through the
+// reconnect endpoint. Note from
+// https://blog.3d-logic.com/2015/03/29/signalr-on-the-wire-an-informal-description-of-the-signalr-protocol/
+// Once the channel is set up there are no further HTTP requests until
+// the client is stopped (the abort request) or the connection was lost
+// and the client tries to re-establish the connection (the reconnect
+// request).
+func (c *Client) reconnect(ctx context.Context, nr NegotiateResponse) (err error) {
+	timeout := c.ConnectTimeout
+	if timeout == 0 {
+		timeout = seconds(nr.TransportConnectTimeout)
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = c.withTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	err = c.refreshToken(ctx)
+	if err != nil {
+		trace.Error(err)
+		return
+	}
+
+	conn, err := c.dial(ctx, nr, "reconnect")
+	if err != nil {
+		trace.Error(err)
+		return
+	}
+
+	// Unlike connect, reconnect needs no start request, and the server
+	// sends no init message.
+	err = c.activate(nr, conn)
+	if err != nil {
+		trace.Error(err)
+		cerr := conn.Close()
+		if cerr != nil {
+			trace.Error(cerr)
+		}
+		return
+	}
+
+	c.rejoinGroups()
+	return
+}
+
+func (c *Client) init(ctx context.Context) (err error) {
+	if c.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = c.withTimeout(ctx, c.ConnectTimeout)
+		defer cancel()
+	}
+
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			err = fmt.Errorf("connection not established in time: %w (%v)", ctx.Err(), err)
+		}
+	}()
+
+	err = c.refreshToken(ctx)
+	if err != nil {
+		trace.Error(err)
+		return
+	}
+
+	fmt.Println("Start init")
+	nr, err := c.negotiate(ctx)
+	if err != nil {
+		trace.Error(err)
+		return
+	}
+
+	err = c.connectNegotiated(ctx, nr)
+	return
+}
+
+// connectNegotiated establishes the connection negotiated in nr.
+func (c *Client) connectNegotiated(ctx context.Context, nr NegotiateResponse) (err error) {
+	// The server discards the connection if the transport isn't established
+	// within its TransportConnectTimeout, so there is no point in waiting
+	// longer than that.
+	if c.ConnectTimeout == 0 && nr.TransportConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = c.withTimeout(ctx, seconds(nr.TransportConnectTimeout))
+		defer cancel()
+	}
+
+	err = c.checkProtocol(nr)
+	if err != nil {
+		trace.Error(err)
+		return
+	}
+
+	if !nr.TryWebSockets {
+		trace.DebugMessage("[signalR.init] Server does not advertise websocket support, trying " + transportWebSockets + " anyway")
+	}
+
+	fmt.Println("init connect")
+	conn, err := c.Connect(ctx, nr)
+	if err != nil {
+		trace.Error(err)
+		return
+	}
+
+	fmt.Println("init start")
+	err = c.Start(ctx, nr, conn)
+	if err != nil {
+		// Don't leak the websocket connection of a failed handshake.
+		cerr := conn.Close()
+		if cerr != nil {
+			trace.Error(cerr)
+		}
+		return
+	}
+
+	c.rejoinGroups()
+	return
+}
+
+// readMessages reads from the current connection until it fails, and returns
+// the reason.
+func (c *Client) readMessages() (err error) {
+	fmt.Println("reading message")
+	conn := c.currentConn()
+	if conn == nil {
+		// Stop or Close got here first.
+		err = ErrNotConnected
+		return
+	}
+	now := c.clock.Now().UnixNano()
+	c.lastReceived.Store(now)
+	c.lastActivity.Store(now)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	timedOut := make(chan struct{})
+	c.goroutine(func() {
+		c.watchdog(conn, stop, timedOut)
+	})
+	if c.IdleTimeout > 0 {
+		c.goroutine(func() {
+			c.idleWatchdog(stop)
+		})
+	}
+
+	for {
+		trace.DebugMessage("[signalR.readMessages] Waiting for message...")
+
+		var p []byte
+		_, p, err = conn.ReadMessage()
+		if err != nil {
+			select {
+			case <-timedOut:
+				err = ErrKeepAliveTimeout
+			default:
+			}
+			if err == websocket.ErrReadLimit {
+				err = c.readLimitError()
+				c.reportError(err)
+			}
+			trace.Error(err)
+			return
+		}
+		receivedAt := c.clock.Now()
+		c.lastReceived.Store(receivedAt.UnixNano())
+
+		trace.DebugMessage("[signalR.readMessages] Message received: " + string(p))
+
+		c.record(p)
+		if c.OnMessageReceivedSize != nil {
+			c.OnMessageReceivedSize(len(p))
+		}
+
+		err = c.handleFrame(p, receivedAt)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// readLimitError describes a message that exceeded MaxMessageSize. The
+// message itself is lost, so the best it can do is tell the last message that
+// was received before it.
+func (c *Client) readLimitError() error {
+	c.mu.Lock()
+	after := c.messageID
+	c.mu.Unlock()
+
+	if after == "" {
+		return fmt.Errorf("%w: message larger than %d bytes", websocket.ErrReadLimit, c.MaxMessageSize)
+	}
+	return fmt.Errorf("%w: message after id %s larger than %d bytes", websocket.ErrReadLimit, after, c.MaxMessageSize)
+}
+
+// idleWatchdog stops the client once no message other than a keep-alive was
+// received or sent for IdleTimeout. It returns once stop is closed.
+func (c *Client) idleWatchdog(stop <-chan struct{}) {
+	for {
+		idle := c.clock.Now().Sub(time.Unix(0, c.lastActivity.Load()))
+		if idle >= c.IdleTimeout {
+			break
+		}
+
+		select {
+		case <-c.done:
+			return
+		case <-stop:
+			return
+		case <-c.clock.After(c.IdleTimeout - idle):
+		}
+	}
+
+	trace.DebugMessage("[signalR.idleWatchdog] Idle timeout, stopping")
+	err := c.Stop()
+	if err != nil {
+		trace.Error(err)
+	}
+}
+
+// LastReceived returns the time at which the last frame, including
+// keep-alives, was received from the server.
+func (c *Client) LastReceived() time.Time {
+	return time.Unix(0, c.lastReceived.Load())
+}
+
+// keepAliveWindow returns how long the connection may go without receiving
+// anything before it is considered dead, or 0 if it is not checked.
+func (c *Client) keepAliveWindow() time.Duration {
+	nr := c.negotiated()
+	if nr.KeepAliveTimeout <= 0 || c.KeepAliveMultiplier < 0 {
+		return 0
+	}
+
+	m := c.KeepAliveMultiplier
+	if m == 0 {
+		m = 1
+	}
+	return time.Duration(float64(seconds(nr.KeepAliveTimeout)) * m)
+}
+
+// watchdog closes conn if nothing is received within the keep-alive window,
+// which makes the read loop fail and the client reconnect. A dropped TCP
+// connection may otherwise go unnoticed indefinitely. It closes timedOut
+// before closing conn, and returns once stop is closed.
+func (c *Client) watchdog(conn *websocket.Conn, stop <-chan struct{}, timedOut chan<- struct{}) {
+	window := c.keepAliveWindow()
+	if window == 0 {
+		return
+	}
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-stop:
+			return
+		case <-c.clock.After(window / 4):
+		}
+
+		if c.clock.Now().Sub(c.LastReceived()) <= window {
+			continue
+		}
+
+		trace.DebugMessage("[signalR.watchdog] Keep-alive timeout, closing connection")
+		close(timedOut)
+		err := conn.Close()
+		if err != nil {
+			trace.Error(err)
+		}
+		return
+	}
+}
+
+// record writes a received frame to RecordTo, if set.
+func (c *Client) record(p []byte) {
+	if c.RecordTo == nil {
+		return
+	}
+
+	_, err := c.RecordTo.Write(append(append([]byte(nil), p...), '\n'))
+	if err != nil {
+		trace.Error(err)
+		c.reportError(err)
+	}
+}
+
+// isKeepAlive reports whether p is a keep-alive frame.
+func (c *Client) isKeepAlive(p []byte) bool {
+	if c.IsKeepAlive != nil {
+		return c.IsKeepAlive(p)
+	}
+	return string(p) == "{}"
+}
+
+// handleFrame processes a single frame received from the server. It returns
+// an error if the connection should end.
+func (c *Client) handleFrame(p []byte, receivedAt time.Time) (err error) {
+	// Ignore KeepAlive messages.
+	if c.isKeepAlive(p) {
+		c.lastKeepAlive.Store(receivedAt.UnixNano())
+		return
+	}
+	c.received.Add(1)
+	c.lastActivity.Store(receivedAt.UnixNano())
+
+	// Hub method results are routed to the Invoke call waiting for them
+	// rather than delivered as messages.
+	if c.dispatchResult(p) {
+		return
+	}
+
+	trace.DebugMessage("[signalR.readMessages] Attempting to unmarshal...")
+
+	var msg Message
+	err = c.codec().Unmarshal(p, &msg)
+	if err != nil {
+		// A single frame we can't decode shouldn't end the connection,
+		// unless the caller asked for that.
+		trace.Error(err)
+		c.reportError(err)
+		if !c.StopOnDecodeError {
+			err = nil
+		}
+		return
+	}
+
+	c.checkFields(p, &messageFields{})
+	c.captureParams(p)
+
+	dbgMsg := fmt.Sprintf("%v", msg)
+	trace.DebugMessage("[signalR.readMessages] Unmarshalled message: " + dbgMsg)
+
+	c.trackMessage(msg)
+
+	// Obey the server's control commands. ConnectLoop closes the connection
+	// and, depending on the command, establishes a new one or gives up.
+	if msg.D == serverDisconnect {
+		trace.DebugMessage("[signalR.readMessages] Disconnect requested by server")
+		err = ErrServerDisconnect
+		return
+	}
+	if msg.T == serverReconnect {
+		trace.DebugMessage("[signalR.readMessages] Reconnect requested by server")
+		err = ErrServerReconnect
+		return
+	}
+
+	if c.MessageInterceptor != nil {
+		var keep bool
+		msg, keep = c.MessageInterceptor(msg)
+		if !keep {
+			return
+		}
+	}
+
+	c.dispatch(msg)
+	c.deliver(msg, receivedAt)
+	return
+}
+
+func (c *Client) deliver(msg Message, receivedAt time.Time) {
+	c.seq++
+
+	c.subsMu.Lock()
+	subs := make([]*subscriber, 0, len(c.subs))
+	for sub := range c.subs {
+		subs = append(subs, sub)
+	}
+	c.subsMu.Unlock()
+	for _, sub := range subs {
+		sub.send(c, msg)
+	}
+
+	if c.DeliverMeta {
+		send(c, c.messagesMeta, MessageMeta{
+			Message:    msg,
+			ReceivedAt: receivedAt,
+			Seq:        c.seq,
+		})
+		return
+	}
+
+	send(c, c.messages, msg)
+}
+
+// send delivers v on ch according to the client's DeliveryPolicy. It never
+// blocks past Close.
+func send[T any](c *Client, ch chan T, v T) {
+	if c.DeliveryPolicy == DeliverDrop {
+		select {
+		case ch <- v:
+		default:
+			c.dropped.Add(1)
+		}
+		return
+	}
+
+	select {
+	case ch <- v:
+	case <-c.done:
+	}
+}
+
+// Dropped returns the number of messages discarded by the DeliverDrop policy.
+func (c *Client) Dropped() uint64 {
+	return c.dropped.Load()
+}
+
+// writeMessage sends a single frame to the websocket connection.
+func (c *Client) writeMessage(ctx context.Context, messageType int, data []byte) (err error) {
+	return c.writeMessages(ctx, messageType, [][]byte{data})
+}
+
+// writeMessages sends frames to the websocket connection in order, holding the
+// write mutex only once.
+//
+// Each frame is flushed to the socket before WriteMessage returns, whatever
+// the write buffer pool, so nothing is left buffered once writeMessages
+// returns and no explicit flush is needed.
+func (c *Client) writeMessages(ctx context.Context, messageType int, frames [][]byte) (err error) {
+	for _, data := range frames {
+		if c.MaxOutboundSize > 0 && len(data) > c.MaxOutboundSize {
+			err = fmt.Errorf("%w: %d > %d bytes", ErrMessageTooLarge, len(data), c.MaxOutboundSize)
+			trace.Error(err)
+			return
+		}
+	}
+
+	return c.write(ctx, len(frames), func(conn *websocket.Conn) (err error) {
+		for _, data := range frames {
+			if c.OnRawSend != nil {
+				c.OnRawSend(data)
+			}
+			if c.OnMessageSentSize != nil {
+				c.OnMessageSentSize(len(data))
+			}
+			if c.EnableCompression {
+				conn.EnableWriteCompression(len(data) >= c.compressionThreshold())
+			}
+			err = conn.WriteMessage(messageType, data)
+			if err != nil {
+				trace.Error(err)
+				return
+			}
+		}
+		return
+	})
+}
+
+func (c *Client) compressionThreshold() int {
+	if c.CompressionThreshold == 0 {
+		return defaultCompressionThreshold
+	}
+	return c.CompressionThreshold
+}
+
+// write calls f with the current connection to send n frames. All writes must
+// go through here so that they are rate limited and serialized by the write
+// mutex.
+func (c *Client) write(ctx context.Context, n int, f func(conn *websocket.Conn) error) (err error) {
+	pending := c.pendingWrites.Add(1)
+	defer c.pendingWrites.Add(-1)
+	if c.MaxPendingWrites > 0 && pending > int64(c.MaxPendingWrites) {
+		err = ErrWriteQueueFull
+		return
+	}
+
+	if c.limiter != nil {
+		err = c.limiter.wait(ctx, n, c.RateLimitFailFast)
+		if err != nil {
+			trace.Error(err)
+			return
+		}
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	conn := c.currentConn()
+	if conn == nil {
+		err = ErrNotConnected
+		return
+	}
+
+	if c.WriteTimeout > 0 {
+		err = conn.SetWriteDeadline(time.Now().Add(c.WriteTimeout))
+		if err != nil {
+			trace.Error(err)
+			return
+		}
+		defer conn.SetWriteDeadline(time.Time{})
+	}
+
+	err = f(conn)
+	if err != nil {
+		var ne net.Error
+		if c.WriteTimeout > 0 && errors.As(err, &ne) && ne.Timeout() {
+			err = fmt.Errorf("%w after %v: %w", ErrWriteTimeout, c.WriteTimeout, err)
+			trace.DebugMessage("[signalR.write] Write timed out, closing connection")
+			if cerr := closeStalled(conn); cerr != nil {
+				trace.Error(cerr)
+			}
+		}
+		return
+	}
+	c.sent.Add(int64(n))
+	c.lastActivity.Store(c.clock.Now().UnixNano())
+	return
+}
+
+// closeStalled closes a connection that writes no longer get through. It
+// closes the network connection underneath TLS directly, since closing the TLS
+// connection would first try to send a close_notify alert, and wait for up to
+// five seconds for it to get through.
+func closeStalled(conn *websocket.Conn) error {
+	if tc, ok := conn.UnderlyingConn().(*tls.Conn); ok {
+		return tc.NetConn().Close()
+	}
+	return conn.Close()
+}
+
+// PendingWrites returns the number of writes in progress, including those
+// waiting for the rate limiter or for the write mutex, which lets only one
+// write through at a time. A growing number means that the connection can't
+// keep up with the sending rate.
+func (c *Client) PendingWrites() int {
+	return int(c.pendingWrites.Load())
+}
+
+// PrepareMessage encodes m once into a frame that can be sent any number of
+// times with WritePrepared, e.g. for heartbeats or other repeated commands.
+// The message is sent as is: set m.I if the server's results must be told
+// apart.
+func (c *Client) PrepareMessage(m hubs.ClientMsg) (pm *websocket.PreparedMessage, err error) {
+	data, err := c.encode(m)
+	if err != nil {
+		trace.Error(err)
+		return
+	}
+
+	if c.MaxOutboundSize > 0 && len(data) > c.MaxOutboundSize {
+		err = fmt.Errorf("%w: %d > %d bytes", ErrMessageTooLarge, len(data), c.MaxOutboundSize)
+		trace.Error(err)
+		return
+	}
+
+	pm, err = websocket.NewPreparedMessage(websocket.TextMessage, data)
+	if err != nil {
+		trace.Error(err)
+		return
+	}
+	return
+}
+
+// WritePrepared sends a message prepared with PrepareMessage.
+func (c *Client) WritePrepared(pm *websocket.PreparedMessage) (err error) {
+	return c.write(context.Background(), 1, func(conn *websocket.Conn) (err error) {
+		err = conn.WritePreparedMessage(pm)
+		if err != nil {
+			trace.Error(err)
+			return
+		}
+		return
+	})
+}
+
+// Send sends a message to the websocket connection. It assigns the message a
+// new invocation id, which it returns so that the caller can match the message
+// to the server's result. The message has been handed to the operating system
+// when Send returns.
+func (c *Client) Send(m hubs.ClientMsg) (id int64, err error) {
+	id = c.nextInvocationID()
+	m.I = id
+
+	err = c.send(context.Background(), m)
+	return
+}
+
+// send sends a message to the websocket connection as is.
+func (c *Client) send(ctx context.Context, m hubs.ClientMsg) (err error) {
+	data, err := c.encode(m)
+	if err != nil {
+		trace.Error(err)
+		return
+	}
+
+	return c.writeMessage(ctx, websocket.TextMessage, data)
+}
+
+// encode serializes a message for sending, attaching the hub state.
+func (c *Client) encode(m hubs.ClientMsg) (data []byte, err error) {
+	err = c.attachState(&m)
+	if err != nil {
+		trace.Error(err)
+		return
+	}
+
+	data, err = c.codec().Marshal(m)
+	if err != nil {
+		trace.Error(err)
+		return
+	}
+	return
+}
+
+// WriteBatch sends several messages, assigning each a new invocation id. The
+// messages are serialized up front and written back to back under a single
+// acquisition of the write mutex; SignalR has no batch frame, so each message
+// is still sent as its own frame.
+func (c *Client) WriteBatch(msgs []hubs.ClientMsg) (err error) {
+	frames := make([][]byte, 0, len(msgs))
+	for _, m := range msgs {
+		m.I = c.nextInvocationID()
+
+		var data []byte
+		data, err = c.encode(m)
+		if err != nil {
+			trace.Error(err)
+			return
+		}
+		frames = append(frames, data)
+	}
+
+	return c.writeMessages(context.Background(), websocket.TextMessage, frames)
+}
+
+// WriteRaw sends data, which must already be a serialized SignalR message, to
+// the websocket connection as a text frame. It is an escape hatch for protocol
+// features not covered by Send and for replaying captured traffic.
+func (c *Client) WriteRaw(data []byte) (err error) {
+	return c.writeMessage(context.Background(), websocket.TextMessage, data)
+}
+
+// Messages returns the channel that receives persistent connection messages.
+// It is the same channel across reconnects, so it only needs to be obtained
+// once. It is closed if the client gives up reconnecting, e.g. because the
+// server rejected it with one of the NonRetryableCloseCodes. If DeliverMeta is
+// set, messages arrive on MessagesWithMeta instead.
+func (c *Client) Messages() <-chan Message {
+	trace.DebugMessage("[signalR.Message] Rreturn message ")
+	return c.messages
+}
+
+// Errors returns the channel that receives errors that don't stop the client,
+// such as frames that can't be decoded. Errors are dropped when the channel's
+// buffer is full.
+func (c *Client) Errors() <-chan error {
+	return c.errs
+}
+
+func (c *Client) reportError(err error) {
+	select {
+	case c.errs <- err:
+	default:
+	}
+}
+
+// Subscribe returns a channel that receives persistent connection messages
+// across reconnects. It is closed when ctx is canceled or the client is closed.
+// Messages are taken from the same stream as Messages, or MessagesWithMeta if
+// DeliverMeta is set, so each message is received by only one of them.
+func (c *Client) Subscribe(ctx context.Context) <-chan Message {
+	out := make(chan Message)
+
+	// Only one of the channels is fed, depending on DeliverMeta.
+	messages, messagesMeta := c.messages, c.messagesMeta
+	if c.DeliverMeta {
+		messages = nil
+	} else {
+		messagesMeta = nil
+	}
+
+	started := c.goroutine(func() {
+		defer close(out)
+
+		for {
+			var msg Message
+			var ok bool
+			select {
+			case <-ctx.Done():
+				return
+			case <-c.done:
+				return
+			case msg, ok = <-messages:
+			case mm, mok := <-messagesMeta:
+				msg, ok = mm.Message, mok
+			}
+			if !ok {
+				return
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-c.done:
+				return
+			case out <- msg:
+			}
+		}
+	})
+	if !started {
+		close(out)
+	}
+
+	return out
+}
+
+// subscriber is a channel returned by MessagesCtx.
+type subscriber struct {
+	// mu is held while sending on ch, so that it isn't closed meanwhile.
+	mu     sync.Mutex
+	ch     chan Message
+	done   <-chan struct{}
+	closed bool
+}
+
+// send delivers msg to the subscriber according to the client's
+// DeliveryPolicy. It never blocks past the subscriber's context or Close.
+func (sub *subscriber) send(c *Client, msg Message) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	if sub.closed {
+		return
+	}
+
+	if c.DeliveryPolicy == DeliverDrop {
+		select {
+		case sub.ch <- msg:
+		default:
+			c.dropped.Add(1)
+		}
+		return
+	}
+
+	select {
+	case sub.ch <- msg:
+	case <-sub.done:
+	case <-c.done:
+	}
+}
+
+// MessagesCtx returns a channel that receives persistent connection messages
+// until ctx is canceled or the client is closed, when it is closed. Messages
+// are fanned out: each channel returned by MessagesCtx receives every message,
+// in addition to the channel returned by Messages or MessagesWithMeta, so
+// request-scoped consumers can come and go without affecting each other, the
+// other consumers or the connection.
+//
+// Each channel is buffered according to MessageBuffer and subject to the
+// DeliveryPolicy: with DeliverBlock, a consumer that stops receiving without
+// canceling its context holds up delivery to all of them. Since messages are
+// still delivered on Messages, a client only read through MessagesCtx should
+// use DeliverDrop, or that channel holds up delivery once its buffer is full.
+func (c *Client) MessagesCtx(ctx context.Context) <-chan Message {
+	sub := &subscriber{
+		ch:   make(chan Message, c.MessageBuffer),
+		done: ctx.Done(),
+	}
+
+	c.subsMu.Lock()
+	c.subs[sub] = struct{}{}
+	c.subsMu.Unlock()
+
+	unsubscribe := func() {
+		c.subsMu.Lock()
+		delete(c.subs, sub)
+		c.subsMu.Unlock()
+
+		sub.mu.Lock()
+		sub.closed = true
+		close(sub.ch)
+		sub.mu.Unlock()
+	}
+
+	started := c.goroutine(func() {
+		select {
+		case <-ctx.Done():
+		case <-c.done:
+		}
+		unsubscribe()
+	})
+	if !started {
+		unsubscribe()
+	}
+
+	return sub.ch
+}
+
+// All returns an iterator over persistent connection messages, for use with
+// range:
+//
+//	for msg, err := range c.All() {
+//		if err != nil {
+//			// The client was closed.
+//			break
+//		}
+//		// ...
+//	}
+//
+// It receives messages like a channel returned by MessagesCtx, which it
+// unsubscribes when the loop ends. Once the client is closed, it yields a zero
+// Message with the error the client stopped on, or ErrClosed, and stops.
+func (c *Client) All() iter.Seq2[Message, error] {
+	return func(yield func(Message, error) bool) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		for msg := range c.MessagesCtx(ctx) {
+			if !yield(msg, nil) {
+				return
+			}
+		}
+
+		err := c.LastError()
+		if err == nil {
+			err = ErrClosed
+		}
+		yield(Message{}, err)
+	}
+}
+
+// MessagesWithMeta returns a channel that receives persistent connection
+// messages along with their arrival time and sequence number, if the client
+// was created with DeliverMeta; otherwise, no messages arrive on it.
+func (c *Client) MessagesWithMeta() <-chan MessageMeta {
+	return c.messagesMeta
+}
+
+// New creates and initializes a SignalR client. It connects to the host and
+// performs the websocket initialization routines that are part of the SignalR
+// specification.
+/*
+func New(host, protocol, connectionData string) (c Client) {
+	err := c.init(host, protocol, connectionData)
+	if err != nil {
+		trace.Error(err)
+		return
+	}
+
+	go c.readMessages()
+
+	return
+}
+*/
+func (c *Client) ConnectLoop(host string, protocol string, connectionData string, reconnect chan bool) {
+	c.connectLoop(reconnect, false)
+}
+
+// connectLoop keeps the client connected until it is closed, announcing each
+// new connection on reconnect, if not nil. If connected is set, the client is
+// already connected when it starts.
+func (c *Client) connectLoop(reconnect chan bool, connected bool) {
+	// since is when the connection was lost, or the first attempt failed;
+	// lostAt is when the connection was lost.
+	attempt := 0
+	var since, lostAt time.Time
+	for {
+		if c.closed() {
+			return
+		}
+
+		if connected {
+			connected = false
+		} else if c.isStopped() {
+			// Wait for Restart, dropping the wake-up of the Stop that
+			// got us here.
+			select {
+			case <-c.wake:
+			default:
+			}
+			select {
+			case <-c.done:
+				return
+			case req := <-c.restarts:
+				err := c.restart(req.ctx)
+				req.result <- err
+				if err != nil {
+					continue
+				}
+			}
+		} else {
+			ctx := c.ctx
+			var req reconnectRequest
+			if c.DisableAutoReconnect && attempt > 0 {
+				select {
+				case <-c.done:
+					return
+				case <-c.wake:
+					// Stop was called, possibly by Restart.
+					continue
+				case req = <-c.reconnects:
+					ctx = req.ctx
+				}
+			}
+
+			fmt.Printf("Initialize new connection\n")
+			ctx, cancel := c.bound(ctx)
+			err := c.establish(ctx, lostAt)
+			cancel()
+			if req.result != nil {
+				req.result <- err
+			}
+			if err != nil {
+				// Start over with a fresh negotiate.
+				trace.Error(err)
+				c.setLastError(err)
+				if attempt == 0 {
+					since = c.clock.Now()
+				}
+				attempt++
+				if c.DisableAutoReconnect {
+					continue
+				}
+				if !c.waitReconnect(attempt, since, err) {
+					return
+				}
+				continue
+			}
+			if c.discardIfStopped() {
+				continue
+			}
+		}
+		attempt = 0
+		lostAt = time.Time{}
+		c.connects.Add(1)
+		c.setLastError(nil)
+		c.logConnected()
+		if reconnect != nil {
+			select {
+			case <-c.done:
+				return
+			case reconnect <- true:
+			}
+		}
+
+		fmt.Printf("Reading messages of new connection\n")
+		conn, gen := c.currentConnGen()
+		err := c.readMessages()
+		if errors.Is(err, ErrServerDisconnect) || errors.Is(err, ErrServerReconnect) {
+			// The connection is still open.
+			c.closeConn(conn, websocket.CloseNormalClosure, "")
+		}
+		c.dropConn(conn)
+		c.failPendingUntil(gen)
+		c.setLastError(err)
+		c.logDisconnected(err)
+		if c.isStopped() {
+			continue
+		}
+
+		if c.nonRetryable(err) {
+			trace.DebugMessage("[signalR.ConnectLoop] Connection can't be resumed, not reconnecting")
+			c.giveUp()
+			return
+		}
+
+		since = c.clock.Now()
+		lostAt = since
+		attempt++
+		if c.DisableAutoReconnect {
+			continue
+		}
+		fmt.Printf("Reading failed, re-loop in 10\n")
+		if !c.waitReconnect(attempt, since, err) {
+			return
+		}
+	}
+}
+
+// restart makes a new connection for Restart and resumes the client.
+func (c *Client) restart(ctx context.Context) (err error) {
+	ctx, cancel := c.bound(ctx)
+	defer cancel()
+
+	err = c.init(ctx)
+	if err != nil {
+		trace.Error(err)
+		return
+	}
+
+	c.mu.Lock()
+	c.stopped = false
+	c.mu.Unlock()
 	return
 }
 
-// func (c *Client) reconnect() {
-// TBD if this is needed. Note from
-// https://blog.3d-logic.com/2015/03/29/signalr-on-the-wire-an-informal-description-of-the-signalr-protocol/
-// Once the channel is set up there are no further HTTP requests until
-// the client is stopped (the abort request) or the connection was lost
-// and the client tries to re-establish the connection (the reconnect
-// request).
-// }
+// discardIfStopped closes the connection ConnectLoop just established if Stop
+// was called meanwhile, which was too early to close it, and reports whether
+// it did.
+func (c *Client) discardIfStopped() bool {
+	c.mu.Lock()
+	if !c.stopped {
+		c.mu.Unlock()
+		return false
+	}
+	conn := c.conn
+	c.clearConn()
+	c.mu.Unlock()
 
-func (c *Client) init(host, protocol, connectionData string) (err error) {
-	fmt.Println("Start init")
-	nr, err := c.negotiate()
+	if conn != nil {
+		err := conn.Close()
+		if err != nil {
+			trace.Error(err)
+		}
+	}
+	return true
+}
+
+// reconnectRequest asks ConnectLoop to make a connection attempt with ctx and
+// send its error on result.
+type reconnectRequest struct {
+	ctx    context.Context
+	result chan error
+}
+
+// Reconnect makes ConnectLoop attempt to reestablish the connection when
+// DisableAutoReconnect is set, and returns the attempt's error. It returns
+// right away if the client is connected, and fails with ErrAutoReconnect if
+// DisableAutoReconnect isn't set, or with ErrStopped after Stop. ctx bounds
+// the attempt.
+func (c *Client) Reconnect(ctx context.Context) (err error) {
+	if !c.DisableAutoReconnect {
+		err = ErrAutoReconnect
+		return
+	}
+	if c.isStopped() {
+		err = ErrStopped
+		return
+	}
+	if c.currentConn() != nil {
+		return
+	}
+
+	req := reconnectRequest{ctx: ctx, result: make(chan error, 1)}
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+		return
+	case <-c.done:
+		err = ErrClosed
+		return
+	case c.reconnects <- req:
+	}
+
+	select {
+	case <-c.done:
+		err = ErrClosed
+	case err = <-req.result:
+	}
+	return
+}
+
+// logConnected logs the details of the connection that was just established.
+func (c *Client) logConnected() {
+	if c.Logger == nil {
+		return
+	}
+
+	nr := c.negotiated()
+	c.Logger.Info("connected",
+		slog.String("connectionId", nr.ConnectionID),
+		slog.String("transport", c.ActiveTransport()),
+		slog.String("protocol", c.connProtocol(nr)),
+		slog.Duration("keepAliveTimeout", seconds(nr.KeepAliveTimeout)),
+		slog.Duration("disconnectTimeout", seconds(nr.DisconnectTimeout)),
+		slog.String("endpoint", c.hostFor(nr)+nr.URL),
+	)
+}
+
+// logDisconnected logs the end of the current connection and its reason.
+func (c *Client) logDisconnected(reason error) {
+	if c.Logger == nil {
+		return
+	}
+
+	nr := c.negotiated()
+	attrs := []interface{}{slog.String("connectionId", nr.ConnectionID)}
+	if reason != nil {
+		attrs = append(attrs, slog.String("reason", reason.Error()))
+	}
+	var ce *websocket.CloseError
+	if errors.As(reason, &ce) {
+		attrs = append(attrs, slog.Int("closeCode", ce.Code))
+	}
+	c.Logger.Info("disconnected", attrs...)
+}
+
+// handleClose is the close handler of every connection. It completes the close
+// handshake started by the server by echoing its close code. The read loop
+// then fails with a *websocket.CloseError, and ConnectLoop decides whether to
+// reconnect based on the code.
+func (c *Client) handleClose(conn *websocket.Conn, code int, text string) error {
+	trace.DebugMessage("[signalR.handleClose] Server closed connection: " + strconv.Itoa(code) + " " + text)
+
+	if code == websocket.CloseNoStatusReceived {
+		code = websocket.CloseNormalClosure
+	}
+
+	// Don't let an unresponsive server hold up the read loop.
+	deadline := time.Now().Add(closeTimeout)
+	err := conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, ""), deadline)
+	if err != nil && err != websocket.ErrCloseSent {
+		trace.Error(err)
+	}
+	return nil
+}
+
+// dropConn forgets conn after its read loop ended, unless it was replaced in
+// the meantime.
+func (c *Client) dropConn(conn *websocket.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == conn {
+		c.clearConn()
+	}
+}
+
+// clearConn forgets the current connection. It must be called with mu held.
+func (c *Client) clearConn() {
+	c.conn = nil
+	c.transport = ""
+	c.connectedSince = time.Time{}
+	select {
+	case <-c.up:
+		c.up = make(chan struct{})
+	default:
+	}
+}
+
+// waitConnected waits until the client has a connection.
+func (c *Client) waitConnected(ctx context.Context) (err error) {
+	c.mu.Lock()
+	up := c.up
+	c.mu.Unlock()
+
+	select {
+	case <-up:
+		return
+	case <-ctx.Done():
+		err = ctx.Err()
+		return
+	case <-c.done:
+		err = ErrClosed
+		return
+	}
+}
+
+// nonRetryable reports whether err closed the connection with one of the
+// NonRetryableCloseCodes, was caused by a message exceeding MaxMessageSize,
+// which reconnecting would only receive again, or is the server telling the
+// client to disconnect.
+func (c *Client) nonRetryable(err error) bool {
+	if errors.Is(err, websocket.ErrReadLimit) || errors.Is(err, ErrServerDisconnect) {
+		return true
+	}
+
+	var ce *websocket.CloseError
+	if !errors.As(err, &ce) {
+		return false
+	}
+
+	codes := c.NonRetryableCloseCodes
+	if codes == nil {
+		codes = defaultNonRetryableCloseCodes
+	}
+	for _, code := range codes {
+		if ce.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// State returns the state of the client's connection.
+func (c *Client) State() State {
+	if c.closed() {
+		return Disconnected
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch {
+	case c.conn != nil:
+		return Connected
+	case c.stopped:
+		return Disconnected
+	case c.lastErr != nil:
+		return Reconnecting
+	}
+	return Connecting
+}
+
+// waitReconnect announces a reconnect attempt and waits before it is made. It
+// returns false if the client was closed in the meantime, or gave up because
+// reconnecting since then would exceed MaxReconnectDuration.
+func (c *Client) waitReconnect(attempt int, since time.Time, reason error) bool {
+	delay := c.jitter(c.reconnectDelay(attempt))
+	if c.MaxReconnectDuration > 0 && c.clock.Now().Add(delay).Sub(since) > c.MaxReconnectDuration {
+		err := fmt.Errorf("%w after %d attempts: %w", ErrReconnectTimeout, attempt-1, reason)
+		trace.Error(err)
+		c.setLastError(err)
+		c.reportError(err)
+		c.giveUp()
+		return false
+	}
+
+	if c.OnReconnect != nil {
+		c.OnReconnect(ReconnectEvent{
+			Attempt: attempt,
+			Delay:   delay,
+			Reason:  reason,
+		})
+	}
+
+	t := c.clock.NewTimer(delay)
+	defer t.Stop()
+
+	select {
+	case <-c.done:
+		return false
+	case <-c.wake:
+		return true
+	case <-t.C():
+		return true
+	}
+}
+
+// reconnectDelay returns the delay before the given reconnect attempt. It
+// doubles with each attempt up to MaxReconnectDelay, if set.
+func (c *Client) reconnectDelay(attempt int) time.Duration {
+	d := reconnectDelay
+	if c.MaxReconnectDelay <= 0 {
+		return d
+	}
+
+	for i := 1; i < attempt && d < c.MaxReconnectDelay; i++ {
+		d *= 2
+	}
+	if d > c.MaxReconnectDelay {
+		d = c.MaxReconnectDelay
+	}
+	return d
+}
+
+// giveUp closes the client for good when it won't reconnect. The reason
+// remains available from LastError. Unlike Close, it also closes the messages
+// channels, since no more messages will arrive.
+func (c *Client) giveUp() {
+	err := c.shutdown(websocket.CloseNormalClosure, "")
+	if err != nil {
+		trace.Error(err)
+	}
+	close(c.messages)
+	close(c.messagesMeta)
+}
+
+// jitter randomly varies d by up to the Jitter fraction in either direction.
+func (c *Client) jitter(d time.Duration) time.Duration {
+	if c.Jitter <= 0 {
+		return d
+	}
+
+	c.rndMu.Lock()
+	f := 1 + c.Jitter*(2*c.rnd.Float64()-1)
+	c.rndMu.Unlock()
+
+	return time.Duration(float64(d) * f)
+}
+
+// LastError returns the error that ended the last connection or connection
+// attempt. It is nil while connected. If the server closed the connection, it
+// is a *websocket.CloseError holding the close code and reason.
+func (c *Client) LastError() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastErr
+}
+
+func (c *Client) setLastError(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastErr = err
+}
+
+func (c *Client) isStopped() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stopped
+}
+
+// abort tells the server that the client is going away.
+func (c *Client) abort(ctx context.Context, nr NegotiateResponse) (err error) {
+	path, err := c.endpointPath(nr, "abort", "")
 	if err != nil {
 		trace.Error(err)
 		return
 	}
+	uri := "https://" + c.hostFor(nr) + path
 
-	fmt.Println("init connect")
-	conn, err := c.connect(nr)
+	req, err := c.newRequest(ctx, http.MethodPost, uri, nil)
 	if err != nil {
 		trace.Error(err)
 		return
 	}
 
-	fmt.Println("init start")
-	err = c.start(nr, conn)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		trace.Error(err)
+		return
+	}
+
+	err = resp.Body.Close()
+	if err != nil {
+		trace.Error(err)
+		return
+	}
 	return
 }
 
-func (c *Client) readMessages() {
-	fmt.Println("reading message")
-	for {
-		trace.DebugMessage("[signalR.readMessages] Waiting for message...")
+// Stop disconnects from the server until Restart is called. Unlike Close, it
+// keeps the client's configuration and handlers, and the messages channel
+// stays open.
+func (c *Client) Stop() (err error) {
+	c.mu.Lock()
+	c.stopped = true
+	conn := c.conn
+	nr := c.nr
+	c.clearConn()
+	c.mu.Unlock()
 
-		_, p, err := c.conn.ReadMessage()
-		if err != nil {
-			trace.Error(err)
-			return
-		}
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
 
-		trace.DebugMessage("[signalR.readMessages] Message received: " + string(p))
+	c.failPending()
+	if conn == nil {
+		return
+	}
 
-		// Ignore KeepAlive messages.
-		if string(p) == "{}" {
-			continue
+	// The abort is a courtesy to the server, which times the connection
+	// out otherwise, so don't wait long for it.
+	ctx, cancel := c.withTimeout(c.ctx, closeTimeout)
+	defer cancel()
+
+	err = c.abort(ctx, nr)
+	if err != nil {
+		trace.Error(err)
+	}
+
+	cerr := conn.Close()
+	if cerr != nil {
+		trace.Error(cerr)
+		if err == nil {
+			err = cerr
 		}
+	}
+	return
+}
 
-		trace.DebugMessage("[signalR.readMessages] Attempting to unmarshal...")
+// Restart establishes a new connection to the server with a fresh negotiate,
+// reusing the client's configuration and handlers. It stops the current
+// connection first if the client isn't stopped yet. The connection is made by
+// ConnectLoop, in place of any reconnect in progress, so Restart waits for
+// ConnectLoop to be ready for it, e.g. to finish a connection attempt.
+func (c *Client) Restart(ctx context.Context) (err error) {
+	if c.closed() {
+		err = ErrClosed
+		return
+	}
 
-		var msg Message
-		err = json.Unmarshal(p, &msg)
+	if !c.isStopped() {
+		err = c.Stop()
 		if err != nil {
 			trace.Error(err)
-			return
 		}
+	}
+
+	req := reconnectRequest{ctx: ctx, result: make(chan error, 1)}
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+		return
+	case <-c.done:
+		err = ErrClosed
+		return
+	case c.restarts <- req:
+	}
+
+	select {
+	case <-c.done:
+		err = ErrClosed
+	case err = <-req.result:
+	}
+	return
+}
+
+func (c *Client) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close permanently shuts down the client. It stops reconnecting, closes the
+// current websocket connection with a normal closure and waits for all of the
+// client's goroutines to exit. Since that includes the read loop, it must not
+// be called from a Handler or any of the client's other callbacks.
+func (c *Client) Close() (err error) {
+	return c.CloseWithCode(websocket.CloseNormalClosure, "")
+}
+
+// CloseWithCode is like Close, but sends the given websocket close code and
+// reason to the server, so it can tell why the client went away.
+func (c *Client) CloseWithCode(code int, text string) (err error) {
+	err = c.shutdown(code, text)
+	c.wg.Wait()
+	return
+}
+
+// bound returns a context that is done when ctx is done or the client is
+// closed, for work on a background goroutine that Close waits for.
+func (c *Client) bound(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(c.ctx, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// goroutine runs f in a background goroutine that Close waits for. f must
+// return once the done channel is closed. Nothing is started once the client
+// is closed; goroutine reports whether f was started.
+func (c *Client) goroutine(f func()) bool {
+	c.goMu.Lock()
+	defer c.goMu.Unlock()
+
+	if c.closed() {
+		return false
+	}
 
-		dbgMsg := fmt.Sprintf("%v", msg)
-		trace.DebugMessage("[signalR.readMessages] Unmarshalled message: " + dbgMsg)
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		f()
+	}()
+	return true
+}
+
+// shutdown closes the client like CloseWithCode, without waiting for the
+// background goroutines to exit, so that they can call it themselves.
+func (c *Client) shutdown(code int, text string) (err error) {
+	c.goMu.Lock()
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.cancel()
+	})
+	c.goMu.Unlock()
+
+	c.mu.Lock()
+	conn := c.conn
+	c.clearConn()
+	c.mu.Unlock()
 
-		c.messages <- msg
+	c.failPending()
+	if conn == nil {
+		return
 	}
+
+	return c.closeConn(conn, code, text)
 }
 
-// Send sends a message to the websocket connection.
-func (c *Client) Send(m hubs.ClientMsg) (err error) {
-	err = c.conn.WriteJSON(m)
+// closeConn sends a close frame with code and text on conn and closes it.
+func (c *Client) closeConn(conn *websocket.Conn, code int, text string) (err error) {
+	// Don't let an unresponsive server hold up closing.
+	deadline := time.Now().Add(closeTimeout)
+	werr := conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), deadline)
+	if werr != nil {
+		trace.Error(werr)
+	}
+
+	err = conn.Close()
 	if err != nil {
 		trace.Error(err)
 		return
@@ -318,52 +3328,142 @@ func (c *Client) Send(m hubs.ClientMsg) (err error) {
 	return
 }
 
-// Messages returns the channel that receives persistent connection messages.
-func (c *Client) Messages() <-chan Message {
-	trace.DebugMessage("[signalR.Message] Rreturn message ")
-	return c.messages
+func New(host string, protocol string, connectionData string, reconnect chan bool, opts ...Option) (c *Client) {
+	c = newClient(host, protocol, connectionData, opts...)
+
+	c.goroutine(func() {
+		c.ConnectLoop(host, protocol, connectionData, reconnect)
+	})
+	if c.PingInterval > 0 {
+		c.goroutine(c.pingLoop)
+	}
+	c.clock.Sleep(10 * time.Second)
+
+	return
 }
 
-// New creates and initializes a SignalR client. It connects to the host and
-// performs the websocket initialization routines that are part of the SignalR
-// specification.
-/*
-func New(host, protocol, connectionData string) (c Client) {
-	err := c.init(host, protocol, connectionData)
+// NewWithNegotiateResponse creates a SignalR client like New, but for a
+// connection negotiated out of band, e.g. by a separate authentication
+// service: it skips the negotiate request and connects using nr. It returns
+// once connected, or with an error if connecting fails. The client resumes
+// lost connections with nr while the server still knows it; after that, it
+// negotiates a new connection itself, so the negotiate endpoint must then be
+// reachable.
+func NewWithNegotiateResponse(host, protocol, connectionData string, nr NegotiateResponse, opts ...Option) (c *Client, err error) {
+	c = newClient(host, protocol, connectionData, opts...)
+
+	ctx := context.Background()
+	if c.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = c.withTimeout(ctx, c.ConnectTimeout)
+		defer cancel()
+	}
+
+	err = c.refreshToken(ctx)
+	if err == nil {
+		err = c.connectNegotiated(ctx, nr)
+	}
 	if err != nil {
 		trace.Error(err)
+		c = nil
 		return
 	}
 
-	go c.readMessages()
+	c.goroutine(func() {
+		c.connectLoop(nil, true)
+	})
+	if c.PingInterval > 0 {
+		c.goroutine(c.pingLoop)
+	}
+	return
+}
+
+// NewReplay creates a client that doesn't connect anywhere, but feeds the
+// frames read from r, as written to RecordTo, through the same processing as
+// frames received from a server. The messages channels are closed once all
+// frames have been replayed.
+func NewReplay(r io.Reader, opts ...Option) (c *Client) {
+	c = newClient("", "", "", opts...)
+
+	c.goroutine(func() {
+		c.replay(r)
+	})
 
 	return
 }
-*/
-func (c *Client) ConnectLoop(host string, protocol string, connectionData string, reconnect chan bool) {
+
+func (c *Client) replay(r io.Reader) {
+	defer func() {
+		close(c.messages)
+		close(c.messagesMeta)
+	}()
+
+	br := bufio.NewReader(r)
 	for {
-		fmt.Printf("Initialize new connection\n")
-		err := c.init(host, protocol, connectionData)
+		p, err := br.ReadBytes('\n')
+		p = bytes.TrimSuffix(p, []byte("\n"))
+		if len(p) > 0 {
+			herr := c.handleFrame(p, c.clock.Now())
+			if herr != nil {
+				trace.Error(herr)
+				return
+			}
+		}
+
+		if err == io.EOF {
+			return
+		}
 		if err != nil {
 			trace.Error(err)
+			c.reportError(err)
+			return
 		}
-		reconnect <- true
-
-		fmt.Printf("Reading messages of new connection\n")
-		c.readMessages()
-		fmt.Printf("Reading failed, re-loop in 10\n")
-		time.Sleep(10 * time.Second)
 	}
 }
 
-func New(host string, protocol string, connectionData string, reconnect chan bool) (c Client) {
+func newClient(host string, protocol string, connectionData string, opts ...Option) (c *Client) {
+	c = new(Client)
+	c.clock = realClock{}
 	c.host = host
 	c.protocol = protocol
 	c.setConnectionData(connectionData)
-	c.messages = make(chan Message)
+	c.done = make(chan struct{})
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.errs = make(chan error, errorsBuffer)
+	c.wake = make(chan struct{}, 1)
+	c.restarts = make(chan reconnectRequest)
+	c.reconnects = make(chan reconnectRequest)
+	c.up = make(chan struct{})
+	c.pending = make(map[int64]*invocation)
+	c.streams = make(map[int64]*stream)
+	c.subs = make(map[*subscriber]struct{})
 
-	go c.ConnectLoop(host, protocol, connectionData, reconnect)
-	time.Sleep(10 * time.Second)
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.messages = make(chan Message, c.MessageBuffer)
+	c.messagesMeta = make(chan MessageMeta, c.MessageBuffer)
+	c.messageID = c.ResumeFrom
+	if c.JitterSource == nil {
+		c.JitterSource = rand.NewSource(c.clock.Now().UnixNano())
+	}
+	c.rnd = rand.New(c.JitterSource)
+	if c.RateLimit > 0 {
+		c.limiter = newRateLimiter(c.clock, c.RateLimit, c.RateBurst)
+	}
+	if c.MaxConcurrentInvokes > 0 {
+		c.invokeSem = make(chan struct{}, c.MaxConcurrentInvokes)
+	}
+
+	if c.HTTPClient != nil {
+		c.httpClient = c.HTTPClient
+	} else {
+		var err error
+		c.httpClient, err = c.newHTTPClient()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	return
 }
@@ -0,0 +1,1229 @@
+package signalr
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rdoorn/signalr/hubs"
+	"github.com/rdoorn/websocket"
+)
+
+func TestWatchdogDetectsMissingKeepAlives(t *testing.T) {
+	s := newTestServer(t, func(s *testServer) {
+		s.keepAlive = 20
+	})
+	clk := newFakeClock()
+	c := s.client(withClock(clk))
+	defer c.Close()
+
+	err := c.init(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-s.conns
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- c.readMessages()
+	}()
+
+	// The watchdog checks every quarter of the keep-alive window, and lets
+	// the connection live for the whole window.
+	for i := 0; i < 4; i++ {
+		clk.waitTimers(t, 1)
+		clk.Advance(5 * time.Second)
+	}
+	select {
+	case err = <-errs:
+		t.Fatalf("connection ended within the keep-alive window: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	clk.waitTimers(t, 1)
+	clk.Advance(5 * time.Second)
+	select {
+	case err = <-errs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not ended after the keep-alive window")
+	}
+	if !errors.Is(err, ErrKeepAliveTimeout) {
+		t.Errorf("readMessages() = %v, want ErrKeepAliveTimeout", err)
+	}
+}
+
+func TestCloseWithoutConsumer(t *testing.T) {
+	s := newTestServer(t)
+	c, conn := s.connected()
+
+	for i := 0; i < 3; i++ {
+		sendFrame(t, conn, `{"C":"d-2","M":[{"H":"chathub","M":"send","A":["hi"]}]}`)
+	}
+	waitFor(t, "a message to be received", func() bool {
+		return c.Stats().TotalMessagesReceived > 0
+	})
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- c.Close()
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close blocked on delivering a message")
+	}
+}
+
+func TestDeliverDropCountsDroppedMessages(t *testing.T) {
+	s := newTestServer(t)
+	c, conn := s.connected(func(c *Client) {
+		c.DeliveryPolicy = DeliverDrop
+		c.MessageBuffer = 1
+	})
+
+	for i := 0; i < 3; i++ {
+		sendFrame(t, conn, `{"C":"d-2","M":[{"H":"chathub","M":"send","A":["hi"]}]}`)
+	}
+	waitFor(t, "two messages to be dropped", func() bool {
+		return c.Dropped() == 2
+	})
+
+	select {
+	case <-c.Messages():
+	default:
+		t.Fatal("first message not buffered")
+	}
+	select {
+	case msg := <-c.Messages():
+		t.Errorf("dropped message delivered: %v", msg)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestReadLoopSkipsMalformedFrames(t *testing.T) {
+	s := newTestServer(t)
+	c, conn := s.connected(func(c *Client) {
+		c.MessageBuffer = 2
+	})
+
+	sendFrame(t, conn, `{"C":"d-2","M":[`)
+	sendFrame(t, conn, `{"C":"d-3","M":[{"H":"chathub","M":"send","A":["one"]}]}`)
+	sendFrame(t, conn, `{"C":"d-4","M":[{"H":"chathub","M":"send","A":["two"]}]}`)
+
+	select {
+	case err := <-c.Errors():
+		if err == nil {
+			t.Error("nil error reported")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("decode error not reported")
+	}
+
+	for _, want := range []string{"d-3", "d-4"} {
+		select {
+		case msg := <-c.Messages():
+			if msg.C != want {
+				t.Errorf("message %s received, want %s", msg.C, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message %s not received", want)
+		}
+	}
+	if c.State() != Connected {
+		t.Errorf("State() = %v, want Connected", c.State())
+	}
+}
+
+func TestStopOnDecodeError(t *testing.T) {
+	s := newTestServer(t)
+	c, conn := s.connected(func(c *Client) {
+		c.StopOnDecodeError = true
+	})
+
+	sendFrame(t, conn, `{"C":"d-2","M":[`)
+	waitFor(t, "the connection to end", func() bool {
+		return c.LastError() != nil
+	})
+}
+
+func TestConnectErrors(t *testing.T) {
+	nr := NegotiateResponse{URL: "/signalr", ConnectionToken: "token", ProtocolVersion: "1.5"}
+
+	t.Run("bad handshake", func(t *testing.T) {
+		s := newTestServer(t, func(s *testServer) {
+			s.rejectConnect = http.StatusForbidden
+		})
+		c := s.client()
+		defer c.Close()
+
+		conn, err := c.Connect(context.Background(), nr)
+		if conn != nil {
+			t.Error("connection returned along with error")
+		}
+		var he *HandshakeError
+		if !errors.As(err, &he) {
+			t.Fatalf("Connect() = %v, want a *HandshakeError", err)
+		}
+		if he.Step != "connect" || he.StatusCode != http.StatusForbidden {
+			t.Errorf("Connect() = %+v, want step connect and status 403", he)
+		}
+	})
+
+	t.Run("dial error", func(t *testing.T) {
+		s := newTestServer(t)
+		c := s.client()
+		defer c.Close()
+		s.Close()
+
+		conn, err := c.Connect(context.Background(), nr)
+		if conn != nil {
+			t.Error("connection returned along with error")
+		}
+		var ne net.Error
+		if !errors.As(err, &ne) {
+			t.Errorf("Connect() = %v, want a net.Error", err)
+		}
+	})
+
+	t.Run("subprotocol not selected", func(t *testing.T) {
+		s := newTestServer(t)
+		c := s.client(func(c *Client) {
+			c.Subprotocols = []string{"signalr.v1"}
+		})
+		defer c.Close()
+
+		conn, err := c.Connect(context.Background(), nr)
+		if conn != nil {
+			t.Error("connection returned along with error")
+		}
+		if err == nil {
+			t.Error("Connect() succeeded without the subprotocol")
+		}
+	})
+}
+
+func TestServerDisconnect(t *testing.T) {
+	s := newTestServer(t)
+	c, conn := s.connected()
+
+	sendFrame(t, conn, `{"C":"d-2","D":1}`)
+
+	select {
+	case _, ok := <-c.Messages():
+		if ok {
+			t.Fatal("message received, want messages channel closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("messages channel not closed")
+	}
+	if !errors.Is(c.LastError(), ErrServerDisconnect) {
+		t.Errorf("LastError() = %v, want ErrServerDisconnect", c.LastError())
+	}
+	if c.State() != Disconnected {
+		t.Errorf("State() = %v, want Disconnected", c.State())
+	}
+}
+
+func TestServerReconnect(t *testing.T) {
+	s := newTestServer(t)
+	clk := newFakeClock()
+	c, conn := s.connected(withClock(clk))
+
+	sendFrame(t, conn, `{"C":"d-2","T":1}`)
+
+	// The client closes the connection it was asked to leave...
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, _, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+	}
+
+	// ...and reconnects after the reconnect delay.
+	clk.waitTimers(t, 1)
+	clk.Advance(reconnectDelay)
+	select {
+	case <-s.conns:
+	case <-time.After(5 * time.Second):
+		t.Fatal("client didn't reconnect")
+	}
+	waitFor(t, "the client to be connected", func() bool {
+		return c.State() == Connected
+	})
+}
+
+func TestRestartWhileReconnecting(t *testing.T) {
+	s := newTestServer(t)
+	clk := newFakeClock()
+	c, conn := s.connected(withClock(clk))
+
+	// Lose the connection; the client waits to reconnect.
+	conn.Close()
+	clk.waitTimers(t, 1)
+
+	err := c.Restart(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-s.conns
+	if c.State() != Connected {
+		t.Errorf("State() = %v after Restart, want Connected", c.State())
+	}
+
+	// The wait for reconnecting was abandoned, so nothing else connects.
+	clk.Advance(reconnectDelay)
+	select {
+	case <-s.conns:
+		t.Fatal("client reconnected after Restart")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Stop and Restart again, once the loop no longer holds a stale
+	// restart.
+	err = c.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the client to be stopped", func() bool {
+		return c.State() == Disconnected
+	})
+	err = c.Restart(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn = <-s.conns
+	if c.State() != Connected {
+		t.Errorf("State() = %v after second Restart, want Connected", c.State())
+	}
+
+	// The new connection is read.
+	sendFrame(t, conn, `{"C":"d-2","M":[{"H":"chathub","M":"send","A":["hi"]}]}`)
+	select {
+	case <-c.Messages():
+	case <-time.After(5 * time.Second):
+		t.Fatal("message on the restarted connection not received")
+	}
+}
+
+func TestManualReconnect(t *testing.T) {
+	s := newTestServer(t)
+	c, conn := s.connected(func(c *Client) {
+		c.DisableAutoReconnect = true
+	})
+
+	conn.Close()
+	waitFor(t, "the connection to be lost", func() bool {
+		return c.State() != Connected
+	})
+	select {
+	case <-s.conns:
+		t.Fatal("client reconnected on its own")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	err := c.Reconnect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn = <-s.conns
+	sendFrame(t, conn, `{"C":"d-2","M":[{"H":"chathub","M":"send","A":["one"]}]}`)
+	select {
+	case <-c.Messages():
+	case <-time.After(5 * time.Second):
+		t.Fatal("message on the reconnected connection not received")
+	}
+
+	// Restart works too, and its connection is read.
+	conn.Close()
+	waitFor(t, "the connection to be lost", func() bool {
+		return c.State() != Connected
+	})
+	err = c.Restart(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn = <-s.conns
+	sendFrame(t, conn, `{"C":"d-3","M":[{"H":"chathub","M":"send","A":["two"]}]}`)
+	select {
+	case <-c.Messages():
+	case <-time.After(5 * time.Second):
+		t.Fatal("message on the restarted connection not received")
+	}
+}
+
+func TestReconnectWithAutoReconnect(t *testing.T) {
+	c := newClient("example.com", "1.5", "")
+	defer c.Close()
+
+	err := c.Reconnect(context.Background())
+	if !errors.Is(err, ErrAutoReconnect) {
+		t.Errorf("Reconnect() = %v, want ErrAutoReconnect", err)
+	}
+}
+
+func TestUpdateConnectionDataAbortsOldConnection(t *testing.T) {
+	s := newTestServer(t)
+	c, _ := s.connected()
+
+	err := c.UpdateConnectionData(context.Background(), `[{"name":"otherhub"}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-s.conns
+
+	waitFor(t, "the abort request", func() bool {
+		return len(s.abortedWith()) > 0
+	})
+	if got := s.abortedWith()[0]; got != `[{"name":"chathub"}]` {
+		t.Errorf("abort sent with connection data %s, want the old one", got)
+	}
+	if got := c.escapedConnectionData(); got != url.QueryEscape(`[{"name":"otherhub"}]`) {
+		t.Errorf("connection data %s after the update", got)
+	}
+}
+
+func TestReadLimitGivesUp(t *testing.T) {
+	payload := `{"C":"d-2","M":[{"H":"chathub","M":"send","A":["` + strings.Repeat("x", 12<<10) + `"]}]}`
+
+	tests := []struct {
+		name string
+		send func(t *testing.T, conn *websocket.Conn)
+	}{
+		{"single frame", func(t *testing.T, conn *websocket.Conn) {
+			sendFrame(t, conn, payload)
+		}},
+		{"fragmented", func(t *testing.T, conn *websocket.Conn) {
+			// The server's 4 KB write buffer is sent as a fragment
+			// whenever it fills up, so none of the fragments is
+			// larger than the limit, only the whole message.
+			w, err := conn.NextWriter(websocket.TextMessage)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for p := payload; p != ""; {
+				n := min(len(p), 4<<10)
+				_, err = w.Write([]byte(p[:n]))
+				if err != nil {
+					t.Fatal(err)
+				}
+				p = p[n:]
+			}
+			err = w.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			c, conn := s.connected(func(c *Client) {
+				c.MaxMessageSize = 8 << 10
+			})
+
+			tt.send(t, conn)
+
+			select {
+			case err := <-c.Errors():
+				if !errors.Is(err, websocket.ErrReadLimit) {
+					t.Errorf("error %v reported, want websocket.ErrReadLimit", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("read limit not reported")
+			}
+			select {
+			case _, ok := <-c.Messages():
+				if ok {
+					t.Fatal("message received, want messages channel closed")
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("client didn't give up")
+			}
+			if !errors.Is(c.LastError(), websocket.ErrReadLimit) {
+				t.Errorf("LastError() = %v, want websocket.ErrReadLimit", c.LastError())
+			}
+			select {
+			case <-s.conns:
+				t.Error("client reconnected")
+			default:
+			}
+		})
+	}
+}
+
+func TestPinnedCertFingerprint(t *testing.T) {
+	s := newTestServer(t)
+	nr := NegotiateResponse{URL: "/signalr", ConnectionToken: "token", ProtocolVersion: "1.5"}
+	sum := sha256.Sum256(s.Certificate().Raw)
+
+	c := s.client(func(c *Client) {
+		c.PinnedCertFingerprint = sum[:]
+	})
+	defer c.Close()
+	conn, err := c.Connect(context.Background(), nr)
+	if err != nil {
+		t.Fatalf("Connect() with the server's fingerprint = %v", err)
+	}
+	conn.Close()
+
+	other := sha256.Sum256([]byte("another certificate"))
+	c = s.client(func(c *Client) {
+		c.PinnedCertFingerprint = other[:]
+	})
+	defer c.Close()
+	conn, err = c.Connect(context.Background(), nr)
+	if conn != nil {
+		t.Error("connection returned along with error")
+	}
+	if err == nil || !strings.Contains(err.Error(), "pinned fingerprint") {
+		t.Errorf("Connect() with another fingerprint = %v, want a fingerprint mismatch", err)
+	}
+}
+
+func TestOrigin(t *testing.T) {
+	s := newTestServer(t)
+	nr := NegotiateResponse{URL: "/signalr", ConnectionToken: "token", ProtocolVersion: "1.5"}
+
+	// The default origin matches the host.
+	c := s.client()
+	defer c.Close()
+	conn, err := c.Connect(context.Background(), nr)
+	if err != nil {
+		t.Fatalf("Connect() with the default origin = %v", err)
+	}
+	conn.Close()
+
+	c = s.client(func(c *Client) {
+		c.Origin = "https://example.com"
+	})
+	defer c.Close()
+	conn, err = c.Connect(context.Background(), nr)
+	if conn != nil {
+		t.Error("connection returned along with error")
+	}
+	var he *HandshakeError
+	if !errors.As(err, &he) || he.StatusCode != http.StatusForbidden {
+		t.Errorf("Connect() with a mismatched origin = %v, want a *HandshakeError with status 403", err)
+	}
+}
+
+func TestProtocolVersions(t *testing.T) {
+	tests := []struct {
+		requested, server string
+		wantErr           bool
+		adopted           string
+	}{
+		{requested: "1.5", server: "1.5", adopted: "1.5"},
+		{requested: "1.5", server: "", adopted: "1.5"},
+		{requested: "1.3", server: "1.5", adopted: "1.5"},
+		{requested: "1.5", server: "1.3", adopted: "1.5"},
+		{requested: "1.5", server: "1.10", adopted: "1.10"},
+		{requested: "1.5", server: "2.0", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		c := newClient("example.com", tt.requested, "", func(c *Client) {
+			c.AdoptServerProtocol = true
+		})
+		defer c.Close()
+		nr := NegotiateResponse{ProtocolVersion: tt.server}
+
+		err := c.checkProtocol(nr)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s against %s: checkProtocol() = %v", tt.requested, tt.server, err)
+		}
+		if err != nil {
+			continue
+		}
+		if got := c.connProtocol(nr); got != tt.adopted {
+			t.Errorf("%s against %s: connProtocol() = %s, want %s", tt.requested, tt.server, got, tt.adopted)
+		}
+	}
+}
+
+func TestNegotiateRedirect(t *testing.T) {
+	s := newTestServer(t)
+	front := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"RedirectUrl":"https://%s/signalr?hub=chathub","AccessToken":"service token"}`, s.host())
+	}))
+	defer front.Close()
+
+	// The origin defaults to the client's host, the application, which the
+	// test server doesn't allow.
+	c := newClient(front.Listener.Addr().String(), "1.5", `[{"name":"chathub"}]`, func(c *Client) {
+		c.HTTPClient = s.Client()
+		c.Origin = "https://" + s.host()
+	})
+	defer c.Close()
+	err := c.init(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-s.conns
+
+	for _, path := range []string{"/signalr/negotiate", "/signalr/connect", "/signalr/start"} {
+		rs := s.received(path)
+		if len(rs) != 1 {
+			t.Errorf("%d %s requests at the redirect target, want 1", len(rs), path)
+			continue
+		}
+		if got := rs[0].Query.Get("hub"); got != "chathub" {
+			t.Errorf("%s: hub = %q, want the redirect's query", path, got)
+		}
+		if got := rs[0].Header.Get("Authorization"); got != "Bearer service token" {
+			t.Errorf("%s: Authorization = %q, want the redirect's token", path, got)
+		}
+	}
+}
+
+func TestNegotiatePost(t *testing.T) {
+	s := newTestServer(t, func(s *testServer) {
+		s.negotiateMethod = http.MethodPost
+	})
+	c := s.client(func(c *Client) {
+		c.NegotiateMethod = http.MethodPost
+		c.NegotiateBody = []byte(`{"tenant":"a"}`)
+		c.TokenProvider = func(ctx context.Context) (string, error) {
+			return "token", nil
+		}
+	})
+	defer c.Close()
+
+	_, err := c.Negotiate(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rs := s.received("/signalr/negotiate")
+	if len(rs) != 1 {
+		t.Fatalf("%d negotiate requests, want 1", len(rs))
+	}
+	r := rs[0]
+	if r.Method != http.MethodPost || r.Body != `{"tenant":"a"}` {
+		t.Errorf("negotiated with %s %s, want POST and the body", r.Method, r.Body)
+	}
+	if got := r.Header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", got)
+	}
+	if got := r.Header.Get("Authorization"); got != "Bearer token" {
+		t.Errorf("Authorization = %q, want the token", got)
+	}
+}
+
+func TestMessagesChannelSurvivesReconnect(t *testing.T) {
+	s := newTestServer(t)
+	clk := newFakeClock()
+	c, conn := s.connected(withClock(clk))
+	msgs := c.Messages()
+
+	conn.Close()
+	clk.waitTimers(t, 1)
+	clk.Advance(reconnectDelay)
+	conn = <-s.conns
+
+	sendFrame(t, conn, `{"C":"d-2","M":[{"H":"chathub","M":"send","A":["hi"]}]}`)
+	select {
+	case msg := <-msgs:
+		if msg.C != "d-2" {
+			t.Errorf("message %s received, want d-2", msg.C)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message after reconnecting not received on the original channel")
+	}
+	if c.Messages() != msgs {
+		t.Error("Messages() returns another channel after reconnecting")
+	}
+}
+
+func TestReconnectReusesNegotiation(t *testing.T) {
+	tests := []struct {
+		name            string
+		alwaysNegotiate bool
+		down            time.Duration
+		wantNegotiate   bool
+	}{
+		{name: "within the disconnect timeout", down: reconnectDelay},
+		{name: "past the disconnect timeout", down: 40 * time.Second, wantNegotiate: true},
+		{name: "always negotiate", alwaysNegotiate: true, down: reconnectDelay, wantNegotiate: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			clk := newFakeClock()
+			c, conn := s.connected(withClock(clk), func(c *Client) {
+				c.AlwaysNegotiate = tt.alwaysNegotiate
+			})
+
+			conn.Close()
+			clk.waitTimers(t, 1)
+			clk.Advance(tt.down)
+			<-s.conns
+			waitFor(t, "the client to be connected", func() bool {
+				return c.State() == Connected
+			})
+
+			negotiated := len(s.received("/signalr/negotiate")) > 0
+			reconnected := len(s.received("/signalr/reconnect")) > 0
+			if negotiated != tt.wantNegotiate || reconnected == tt.wantNegotiate {
+				t.Errorf("negotiated: %v, reconnected: %v; want negotiated: %v",
+					negotiated, reconnected, tt.wantNegotiate)
+			}
+		})
+	}
+}
+
+func TestDialRetries(t *testing.T) {
+	// Nothing listens on the address until the second retry.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	clk := newFakeClock()
+	nr := NegotiateResponse{URL: "/signalr", ConnectionToken: "token", ProtocolVersion: "1.5"}
+	c := newClient(addr, "1.5", `[{"name":"chathub"}]`, withClock(clk), func(c *Client) {
+		c.DialRetries = 3
+	})
+	defer c.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		conn, err := c.Connect(context.Background(), nr)
+		if err == nil {
+			conn.Close()
+		}
+		errs <- err
+	}()
+
+	clk.waitTimers(t, 1)
+	clk.Advance(time.Second)
+	clk.waitTimers(t, 1)
+	s := newTestServer(t, func(s *testServer) {
+		s.addr = addr
+	})
+	clk.Advance(2 * time.Second)
+
+	select {
+	case err = <-errs:
+		if err != nil {
+			t.Fatalf("Connect() = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Connect() didn't return")
+	}
+	if n := len(s.received("/signalr/connect")); n != 1 {
+		t.Errorf("%d connect requests, want 1", n)
+	}
+}
+
+func TestNoNegotiateRedirects(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" {
+			fmt.Fprint(w, "<html>Sign in</html>")
+			return
+		}
+		http.Redirect(w, r, "/login", http.StatusFound)
+	}))
+	defer srv.Close()
+
+	unauthorized := false
+	c := newClient(srv.Listener.Addr().String(), "1.5", "", func(c *Client) {
+		c.HTTPClient = srv.Client()
+		c.NoNegotiateRedirects = true
+		c.OnUnauthorized = func(ctx context.Context) error {
+			unauthorized = true
+			return nil
+		}
+	})
+	defer c.Close()
+
+	_, err := c.Negotiate(context.Background())
+	var he *HandshakeError
+	if !errors.As(err, &he) {
+		t.Fatalf("Negotiate() = %v, want a *HandshakeError", err)
+	}
+	if he.StatusCode != http.StatusFound || he.Location != "/login" {
+		t.Errorf("Negotiate() = %+v, want status 302 and the login location", he)
+	}
+	if unauthorized {
+		t.Error("OnUnauthorized called for a redirect")
+	}
+
+	// Following the redirect ends up at the login page, which isn't a
+	// negotiate response.
+	c = newClient(srv.Listener.Addr().String(), "1.5", "", func(c *Client) {
+		c.HTTPClient = srv.Client()
+	})
+	defer c.Close()
+	_, err = c.Negotiate(context.Background())
+	if err == nil || errors.As(err, &he) {
+		t.Errorf("Negotiate() following the redirect = %v, want a decode error", err)
+	}
+}
+
+func TestReplayParams(t *testing.T) {
+	s := newTestServer(t)
+	clk := newFakeClock()
+	c, conn := s.connected(withClock(clk), func(c *Client) {
+		c.DeliveryPolicy = DeliverDrop
+		c.ReplayParams = map[string]string{"RoutingId": "routingId", "Shard": "shard"}
+	})
+
+	// Values captured from the negotiate response...
+	c.captureParams([]byte(`{"Url":"/signalr","RoutingId":"negotiated"}`))
+	if got := c.replayParams(); got != "&routingId=negotiated" {
+		t.Errorf("replayParams() = %q after negotiating", got)
+	}
+
+	// ...are replaced by those of later messages.
+	sendFrame(t, conn, `{"C":"d-2","RoutingId":"r 1","Shard":7,"M":[]}`)
+	waitFor(t, "the message to be received", func() bool {
+		return c.Stats().TotalMessagesReceived == 1
+	})
+
+	conn.Close()
+	clk.waitTimers(t, 1)
+	clk.Advance(reconnectDelay)
+	<-s.conns
+
+	rs := s.received("/signalr/reconnect")
+	if len(rs) != 1 {
+		t.Fatalf("%d reconnect requests, want 1", len(rs))
+	}
+	if got := rs[0].Query.Get("routingId"); got != "r 1" {
+		t.Errorf("routingId = %q, want r 1", got)
+	}
+	if got := rs[0].Query.Get("shard"); got != "7" {
+		t.Errorf("shard = %q, want 7", got)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	s := newTestServer(t)
+	clk := newFakeClock()
+	c, conn := s.connected(withClock(clk), func(c *Client) {
+		c.WriteTimeout = 50 * time.Millisecond
+	})
+
+	// The server never reads, so the writes stall once the socket buffers
+	// are full. Keep them small, so that doesn't take long.
+	tcp := conn.UnderlyingConn().(*tls.Conn).NetConn().(*net.TCPConn)
+	err := tcp.SetReadBuffer(4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	arg := strings.Repeat("x", 64<<10)
+	for i := 0; i < 1000 && err == nil; i++ {
+		_, err = c.Send(hubs.ClientMsg{H: "chathub", M: "send", A: []interface{}{arg}})
+	}
+	if !errors.Is(err, ErrWriteTimeout) {
+		t.Fatalf("Send() = %v, want ErrWriteTimeout", err)
+	}
+
+	// The connection is dropped, and a new one established.
+	clk.waitTimers(t, 1)
+	clk.Advance(reconnectDelay)
+	select {
+	case <-s.conns:
+	case <-time.After(5 * time.Second):
+		t.Fatal("client didn't reconnect after the write timed out")
+	}
+}
+
+func TestHostHeader(t *testing.T) {
+	s := newTestServer(t)
+	c := s.client(func(c *Client) {
+		c.HostHeader = "chat.example.com"
+	})
+	defer c.Close()
+
+	err := c.init(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-s.conns
+
+	for _, path := range []string{"/signalr/negotiate", "/signalr/connect", "/signalr/start"} {
+		for _, r := range s.received(path) {
+			if r.Host != "chat.example.com" {
+				t.Errorf("%s: Host = %q, want chat.example.com", path, r.Host)
+			}
+		}
+	}
+	if got := s.received("/signalr/connect")[0].Header.Get("Origin"); got != "https://chat.example.com" {
+		t.Errorf("Origin = %q, want https://chat.example.com", got)
+	}
+}
+
+func TestServerName(t *testing.T) {
+	s := newTestServer(t)
+	nr := NegotiateResponse{URL: "/signalr", ConnectionToken: "token", ProtocolVersion: "1.5"}
+
+	// The test server's certificate is valid for example.com.
+	c := s.client(func(c *Client) {
+		c.ServerName = "example.com"
+	})
+	defer c.Close()
+	conn, err := c.Connect(context.Background(), nr)
+	if err != nil {
+		t.Fatalf("Connect() with a valid server name = %v", err)
+	}
+	conn.Close()
+
+	c = s.client(func(c *Client) {
+		c.ServerName = "other.example"
+	})
+	defer c.Close()
+	conn, err = c.Connect(context.Background(), nr)
+	if conn != nil {
+		t.Error("connection returned along with error")
+	}
+	var he x509.HostnameError
+	if !errors.As(err, &he) {
+		t.Errorf("Connect() with another server name = %v, want an x509.HostnameError", err)
+	}
+}
+
+// batch returns n small hub messages.
+func batch(n int) []hubs.ClientMsg {
+	msgs := make([]hubs.ClientMsg, n)
+	for i := range msgs {
+		msgs[i] = hubs.ClientMsg{H: "chathub", M: "send", A: []interface{}{"hi", i}}
+	}
+	return msgs
+}
+
+func BenchmarkWriteBatch(b *testing.B) {
+	s := newTestServer(b)
+	c, conn := s.connected()
+	discard(conn)
+	msgs := batch(16)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := c.WriteBatch(msgs)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSendEach(b *testing.B) {
+	s := newTestServer(b)
+	c, conn := s.connected()
+	discard(conn)
+	msgs := batch(16)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, m := range msgs {
+			_, err := c.Send(m)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkWritePrepared(b *testing.B) {
+	s := newTestServer(b)
+	c, conn := s.connected()
+	discard(conn)
+	pm, err := c.PrepareMessage(hubs.ClientMsg{H: "chathub", M: "heartbeat", A: []interface{}{"alive"}})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := c.WritePrepared(pm)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSendSame(b *testing.B) {
+	s := newTestServer(b)
+	c, conn := s.connected()
+	discard(conn)
+	m := hubs.ClientMsg{H: "chathub", M: "heartbeat", A: []interface{}{"alive"}}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := c.Send(m)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadLargeMessages(b *testing.B) {
+	frame := `{"C":"d-2","M":[{"H":"chathub","M":"send","A":["` + strings.Repeat("x", 256<<10) + `"]}]}`
+
+	for _, size := range []int{0, 64 << 10} {
+		b.Run(fmt.Sprintf("buffer=%d", size), func(b *testing.B) {
+			s := newTestServer(b)
+			c, conn := s.connected(func(c *Client) {
+				c.ReadBufferSize = size
+			})
+
+			b.SetBytes(int64(len(frame)))
+			b.ResetTimer()
+			go func() {
+				for i := 0; i < b.N; i++ {
+					err := conn.WriteMessage(websocket.TextMessage, []byte(frame))
+					if err != nil {
+						return
+					}
+				}
+			}()
+			for i := 0; i < b.N; i++ {
+				<-c.Messages()
+			}
+		})
+	}
+}
+
+func BenchmarkCompression(b *testing.B) {
+	for _, size := range []int{64, 16 << 10} {
+		for _, threshold := range []int{0, -1} {
+			name := fmt.Sprintf("size=%d/threshold=default", size)
+			if threshold < 0 {
+				name = fmt.Sprintf("size=%d/threshold=none", size)
+			}
+			b.Run(name, func(b *testing.B) {
+				s := newTestServer(b)
+				c, conn := s.connected(func(c *Client) {
+					c.EnableCompression = true
+					c.CompressionThreshold = threshold
+				})
+				discard(conn)
+				m := hubs.ClientMsg{H: "chathub", M: "send", A: []interface{}{strings.Repeat("hello ", size/6)}}
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					_, err := c.Send(m)
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestMessagesCtxDoesNotStealMessages(t *testing.T) {
+	s := newTestServer(t)
+	c, conn := s.connected(func(c *Client) {
+		c.MessageBuffer = 1
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sub := c.MessagesCtx(ctx)
+
+	receive := func(ch <-chan Message, name, want string) {
+		t.Helper()
+		select {
+		case msg := <-ch:
+			if msg.C != want {
+				t.Errorf("%s received %s, want %s", name, msg.C, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message %s not received on %s", want, name)
+		}
+	}
+
+	// Both consumers receive the message...
+	sendFrame(t, conn, `{"C":"d-2","M":[{"H":"chathub","M":"send","A":["hi"]}]}`)
+	receive(c.Messages(), "Messages()", "d-2")
+	receive(sub, "MessagesCtx()", "d-2")
+
+	// ...and Messages keeps receiving once the subscriber is gone.
+	cancel()
+	for range sub {
+	}
+	sendFrame(t, conn, `{"C":"d-3","M":[{"H":"chathub","M":"send","A":["hi"]}]}`)
+	receive(c.Messages(), "Messages()", "d-3")
+}
+
+func TestDeliverMeta(t *testing.T) {
+	frame := `{"C":"d-2","M":[{"H":"chathub","M":"send","A":["hi"]}]}`
+
+	// Asking for the channel doesn't divert messages from Messages.
+	s := newTestServer(t)
+	c, conn := s.connected()
+	c.MessagesWithMeta()
+	sendFrame(t, conn, frame)
+	select {
+	case <-c.Messages():
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not received on Messages() after MessagesWithMeta()")
+	}
+
+	c, conn = s.connected(func(c *Client) {
+		c.DeliverMeta = true
+	})
+	sendFrame(t, conn, frame)
+	select {
+	case mm := <-c.MessagesWithMeta():
+		if mm.C != "d-2" || mm.Seq != 1 || mm.ReceivedAt.IsZero() {
+			t.Errorf("MessagesWithMeta() received %+v", mm)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not received on MessagesWithMeta()")
+	}
+
+	// Subscribe takes messages from the channel in use.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sub := c.Subscribe(ctx)
+	sendFrame(t, conn, `{"C":"d-3","M":[{"H":"chathub","M":"send","A":["hi"]}]}`)
+	select {
+	case msg := <-sub:
+		if msg.C != "d-3" {
+			t.Errorf("Subscribe() received %s, want d-3", msg.C)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not received on Subscribe() with DeliverMeta")
+	}
+}
+
+func TestConnectAndCloseRepeatedly(t *testing.T) {
+	s := newTestServer(t)
+	connectAndClose := func() {
+		c, _ := s.connected(func(c *Client) {
+			c.PingInterval = time.Minute
+		})
+
+		closed := make(chan error, 1)
+		go func() {
+			closed <- c.Close()
+		}()
+		select {
+		case <-closed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Close blocked")
+		}
+		if c.ctx.Err() == nil {
+			t.Fatal("background requests not canceled by Close")
+		}
+		if c.goroutine(func() {}) {
+			t.Fatal("goroutine started after Close")
+		}
+	}
+
+	// The first connection sets up what the test server and its HTTP
+	// client keep around.
+	connectAndClose()
+	base := runtime.NumGoroutine()
+	for i := 0; i < 50; i++ {
+		connectAndClose()
+	}
+
+	// Close waits for the client's goroutines, but those of the websocket
+	// and HTTP libraries may take a moment to notice.
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > base {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			t.Fatalf("%d goroutines left, want at most %d:\n%s",
+				runtime.NumGoroutine(), base, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHandshakeHTTP2(t *testing.T) {
+	for _, disable := range []bool{false, true} {
+		s := newTestServer(t, func(s *testServer) {
+			s.http2 = true
+		})
+		// The client's own HTTP client, not the test server's, decides
+		// which protocol to use.
+		c := newClient(s.host(), "1.5", `[{"name":"chathub"}]`, func(c *Client) {
+			c.DisableHTTP2 = disable
+		})
+		defer c.Close()
+
+		err := c.init(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-s.conns
+
+		want := 2
+		if disable {
+			want = 1
+		}
+		for _, path := range []string{"/signalr/negotiate", "/signalr/start"} {
+			rs := s.received(path)
+			if len(rs) != 1 {
+				t.Fatalf("%d %s requests, want 1", len(rs), path)
+			}
+			if rs[0].Proto != want {
+				t.Errorf("DisableHTTP2 %v: %s over HTTP/%d, want HTTP/%d", disable, path, rs[0].Proto, want)
+			}
+		}
+		// The websocket upgrade always uses HTTP/1.1.
+		if r := s.received("/signalr/connect")[0]; r.Proto != 1 {
+			t.Errorf("DisableHTTP2 %v: connect over HTTP/%d, want HTTP/1", disable, r.Proto)
+		}
+	}
+}
+
+func TestSendIsFlushed(t *testing.T) {
+	// Generous enough for a loaded machine, but far below any buffering
+	// delay, such as waiting for the next write or a keep-alive.
+	const bound = 250 * time.Millisecond
+
+	for _, compress := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compression=%v", compress), func(t *testing.T) {
+			s := newTestServer(t)
+			c, conn := s.connected(func(c *Client) {
+				c.EnableCompression = compress
+				c.CompressionThreshold = -1
+			})
+
+			for i := 0; i < 10; i++ {
+				start := time.Now()
+				id, err := c.Send(hubs.ClientMsg{H: "chathub", M: "send", A: []interface{}{"hi"}})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				// Nothing else is sent that could push the message
+				// out of a buffer.
+				cm := readInvocation(t, conn)
+				if cm.I != id {
+					t.Fatalf("call %d received, want %d", cm.I, id)
+				}
+				if d := time.Since(start); d > bound {
+					t.Errorf("message %d took %v to arrive, want at most %v", i+1, d, bound)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package signalr
+
+import (
+	"encoding/json"
+
+	"github.com/carterjones/helpers/trace"
+	"github.com/rdoorn/signalr/hubs"
+)
+
+// HubState returns the value of a key in the hub state. The state is sent
+// along with every outgoing hub message and is updated from the state the
+// server sends back.
+func (c *Client) HubState(key string) (value json.RawMessage, ok bool) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	value, ok = c.state[key]
+	return
+}
+
+// SetHubState sets the value of a key in the hub state.
+func (c *Client) SetHubState(key string, value json.RawMessage) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	if c.state == nil {
+		c.state = make(map[string]json.RawMessage)
+	}
+	c.state[key] = value
+}
+
+// mergeState merges state received from the server into the hub state.
+func (c *Client) mergeState(s *json.RawMessage) {
+	if s == nil {
+		return
+	}
+
+	var update map[string]json.RawMessage
+	err := c.codec().Unmarshal(*s, &update)
+	if err != nil {
+		trace.Error(err)
+		c.reportError(err)
+		return
+	}
+
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	if c.state == nil {
+		c.state = make(map[string]json.RawMessage)
+	}
+	for k, v := range update {
+		c.state[k] = v
+	}
+}
+
+// attachState sets the hub state on m unless m carries its own.
+func (c *Client) attachState(m *hubs.ClientMsg) (err error) {
+	if m.S != nil {
+		return
+	}
+
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	if len(c.state) == 0 {
+		return
+	}
+
+	data, err := c.codec().Marshal(c.state)
+	if err != nil {
+		trace.Error(err)
+		return
+	}
+
+	s := json.RawMessage(data)
+	m.S = &s
+	return
+}
@@ -0,0 +1,43 @@
+package signalr
+
+import (
+	"time"
+)
+
+// ConnectionStats is a snapshot of a client's connection statistics.
+type ConnectionStats struct {
+	// ConnectedSince is when the current connection was established, or
+	// the zero time if the client isn't connected.
+	ConnectedSince time.Time
+
+	// TotalReconnects is the number of connections established after the
+	// first one.
+	TotalReconnects int
+
+	// TotalMessagesReceived and TotalMessagesSent count the frames
+	// exchanged with the server, other than keep-alives, over all
+	// connections.
+	TotalMessagesReceived int64
+	TotalMessagesSent     int64
+
+	// LastKeepAlive is when the last keep-alive was received, or the zero
+	// time if none was.
+	LastKeepAlive time.Time
+}
+
+// Stats returns the client's connection statistics.
+func (c *Client) Stats() (s ConnectionStats) {
+	c.mu.Lock()
+	s.ConnectedSince = c.connectedSince
+	c.mu.Unlock()
+
+	if n := c.connects.Load(); n > 1 {
+		s.TotalReconnects = int(n - 1)
+	}
+	s.TotalMessagesReceived = c.received.Load()
+	s.TotalMessagesSent = c.sent.Load()
+	if t := c.lastKeepAlive.Load(); t != 0 {
+		s.LastKeepAlive = time.Unix(0, t)
+	}
+	return
+}